@@ -32,6 +32,15 @@ func (r *RESREF) MarshalJSON() ([]byte, error) {
 	return json.Marshal(r.String())
 }
 
+func (r *RESREF) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err != nil {
+		return err
+	}
+	*r = NewResref(name)
+	return nil
+}
+
 func (r *RESREF) Valid() bool {
 	return r.String() != ""
 }
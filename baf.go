@@ -0,0 +1,628 @@
+package bg
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// ScriptError is returned when a BAF script or a script string cannot be
+// compiled.
+type ScriptError struct {
+	Line   int
+	Column int
+	Msg    string
+}
+
+func (e ScriptError) Error() string {
+	return fmt.Sprintf("line %d, column %d: %s", e.Line, e.Column, e.Msg)
+}
+
+const (
+	SCRIPT_ARG_INT = iota
+	SCRIPT_ARG_STRING
+	SCRIPT_ARG_SYMBOL
+	SCRIPT_ARG_LIST
+	SCRIPT_ARG_CALL
+)
+
+// A ScriptArg is an argument as written, lists are the bracketed object
+// specifiers and points and calls are object functions or the action of
+// ActionOverride.  Type is the IDS argument type, set once the call has been
+// checked against the IDS files.
+type ScriptArg struct {
+	Kind   int
+	Type   int
+	Int    int
+	Str    string
+	Fields []string
+	Call   *ScriptCall
+	Line   int
+	Column int
+}
+
+// A ScriptCall is a trigger or action as written
+type ScriptCall struct {
+	Name    string
+	Negated bool
+	Args    []ScriptArg
+	Line    int
+	Column  int
+}
+
+const (
+	bafTokEOF = iota
+	bafTokWord
+	bafTokInt
+	bafTokString
+	bafTokPunct
+)
+
+type bafToken struct {
+	Kind   int
+	Text   string
+	Line   int
+	Column int
+}
+
+func (tok bafToken) errorf(format string, args ...interface{}) error {
+	return ScriptError{Line: tok.Line, Column: tok.Column, Msg: fmt.Sprintf(format, args...)}
+}
+
+func isBafWord(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || isBcsDigit(c)
+}
+
+func bafTokenize(src string, line int) ([]bafToken, error) {
+	tokens := []bafToken{}
+	col := 1
+	advance := func(n int) {
+		for _, c := range src[:n] {
+			if c == '\n' {
+				line++
+				col = 1
+			} else {
+				col++
+			}
+		}
+		src = src[n:]
+	}
+
+	for {
+		for len(src) > 0 && strings.ContainsRune(" \t\r\n", rune(src[0])) {
+			advance(1)
+		}
+		tok := bafToken{Line: line, Column: col}
+		if len(src) == 0 {
+			return append(tokens, tok), nil
+		}
+
+		switch c := src[0]; {
+		case strings.HasPrefix(src, "//"):
+			end := strings.IndexByte(src, '\n')
+			if end < 0 {
+				end = len(src)
+			}
+			advance(end)
+			continue
+		case strings.HasPrefix(src, "/*"):
+			end := strings.Index(src, "*/")
+			if end < 0 {
+				return nil, tok.errorf("unterminated comment")
+			}
+			advance(end + 2)
+			continue
+		case c == '"' || c == '~' || c == '%':
+			end := strings.IndexByte(src[1:], c)
+			if end < 0 {
+				return nil, tok.errorf("unterminated string")
+			}
+			tok.Kind = bafTokString
+			tok.Text = src[1 : 1+end]
+			advance(end + 2)
+		case c == '-' || isBcsDigit(c):
+			end := 1
+			for end < len(src) && isBcsDigit(src[end]) {
+				end++
+			}
+			if src[:end] == "-" {
+				return nil, tok.errorf("unexpected -")
+			}
+			tok.Kind = bafTokInt
+			tok.Text = src[:end]
+			advance(end)
+		case isBafWord(c):
+			end := 0
+			for end < len(src) && isBafWord(src[end]) {
+				end++
+			}
+			tok.Kind = bafTokWord
+			tok.Text = src[:end]
+			advance(end)
+		case strings.IndexByte("()[],.!#", c) >= 0:
+			tok.Kind = bafTokPunct
+			tok.Text = src[:1]
+			advance(1)
+		default:
+			return nil, tok.errorf("unexpected %q", c)
+		}
+		tokens = append(tokens, tok)
+	}
+}
+
+type bafParser struct {
+	tokens []bafToken
+	pos    int
+}
+
+func (p *bafParser) peek() bafToken {
+	return p.tokens[p.pos]
+}
+
+func (p *bafParser) next() bafToken {
+	tok := p.tokens[p.pos]
+	if tok.Kind != bafTokEOF {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *bafParser) isPunct(text string) bool {
+	tok := p.peek()
+	return tok.Kind == bafTokPunct && tok.Text == text
+}
+
+func (p *bafParser) isKeyword(word string) bool {
+	tok := p.peek()
+	return tok.Kind == bafTokWord && strings.EqualFold(tok.Text, word)
+}
+
+func (p *bafParser) expectPunct(text string) error {
+	if tok := p.next(); tok.Kind != bafTokPunct || tok.Text != text {
+		return tok.errorf("expected %s", text)
+	}
+	return nil
+}
+
+func (p *bafParser) expectKeyword(word string) error {
+	if tok := p.next(); tok.Kind != bafTokWord || !strings.EqualFold(tok.Text, word) {
+		return tok.errorf("expected %s", word)
+	}
+	return nil
+}
+
+func (p *bafParser) arg() (ScriptArg, error) {
+	tok := p.next()
+	arg := ScriptArg{Line: tok.Line, Column: tok.Column}
+	switch {
+	case tok.Kind == bafTokInt:
+		arg.Kind = SCRIPT_ARG_INT
+		arg.Int, _ = strconv.Atoi(tok.Text)
+	case tok.Kind == bafTokString:
+		arg.Kind = SCRIPT_ARG_STRING
+		arg.Str = tok.Text
+	case tok.Kind == bafTokPunct && tok.Text == "[":
+		arg.Kind = SCRIPT_ARG_LIST
+		for {
+			field := p.next()
+			if field.Kind != bafTokWord && field.Kind != bafTokInt {
+				return arg, field.errorf("expected specifier")
+			}
+			arg.Fields = append(arg.Fields, field.Text)
+			if p.isPunct("]") {
+				p.next()
+				break
+			}
+			if err := p.expectPunct("."); err != nil {
+				return arg, err
+			}
+		}
+	case tok.Kind == bafTokWord && p.isPunct("("):
+		p.pos--
+		call, err := p.call()
+		if err != nil {
+			return arg, err
+		}
+		arg.Kind = SCRIPT_ARG_CALL
+		arg.Call = call
+	case tok.Kind == bafTokWord:
+		arg.Kind = SCRIPT_ARG_SYMBOL
+		arg.Str = tok.Text
+	default:
+		return arg, tok.errorf("expected argument")
+	}
+	return arg, nil
+}
+
+func (p *bafParser) call() (*ScriptCall, error) {
+	tok := p.next()
+	call := &ScriptCall{Line: tok.Line, Column: tok.Column}
+	if tok.Kind == bafTokPunct && tok.Text == "!" {
+		call.Negated = true
+		tok = p.next()
+	}
+	if tok.Kind != bafTokWord {
+		return nil, tok.errorf("expected name")
+	}
+	call.Name = tok.Text
+	if err := p.expectPunct("("); err != nil {
+		return nil, err
+	}
+	if p.isPunct(")") {
+		p.next()
+		return call, nil
+	}
+	for {
+		arg, err := p.arg()
+		if err != nil {
+			return nil, err
+		}
+		call.Args = append(call.Args, arg)
+		if p.isPunct(")") {
+			p.next()
+			return call, nil
+		}
+		if err := p.expectPunct(","); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (ids *ScriptIDS) compileObject(arg ScriptArg) (BcsObject, error) {
+	obj := BcsObject{}
+	pos := ScriptError{Line: arg.Line, Column: arg.Column}
+	switch arg.Kind {
+	case SCRIPT_ARG_STRING:
+		obj.Name = arg.Str
+	case SCRIPT_ARG_LIST:
+		if len(arg.Fields) > len(ids.Specifiers) {
+			pos.Msg = fmt.Sprintf("too many object specifiers: %d", len(arg.Fields))
+			return obj, pos
+		}
+		fields := []*int{&obj.EA, &obj.General, &obj.Race, &obj.Class, &obj.Specific, &obj.Gender, &obj.Alignment}
+		for idx, field := range arg.Fields {
+			v, ok := ids.Specifiers[idx].value(field)
+			if !ok {
+				pos.Msg = fmt.Sprintf("unknown %s %s%s", scriptSpecifierIds[idx], field, ids.Specifiers[idx].suggest(field))
+				return obj, pos
+			}
+			*fields[idx] = v
+		}
+	case SCRIPT_ARG_SYMBOL, SCRIPT_ARG_CALL:
+		name := arg.Str
+		if arg.Kind == SCRIPT_ARG_CALL {
+			name = arg.Call.Name
+			if len(arg.Call.Args) != 1 {
+				pos.Msg = fmt.Sprintf("%s takes 1 argument", name)
+				return obj, pos
+			}
+			inner, err := ids.compileObject(arg.Call.Args[0])
+			if err != nil {
+				return obj, err
+			}
+			obj = inner
+		}
+		entry := ids.Object.ByName(name)
+		if entry == nil {
+			pos.Msg = fmt.Sprintf("unknown object %s%s", name, ids.Object.suggest(name))
+			return obj, pos
+		}
+		idx := 0
+		for idx < len(obj.Identifiers) && obj.Identifiers[idx] != 0 {
+			idx++
+		}
+		if idx == len(obj.Identifiers) {
+			pos.Msg = fmt.Sprintf("object nested too deeply at %s", name)
+			return obj, pos
+		}
+		obj.Identifiers[idx] = entry.Id
+	default:
+		pos.Msg = "expected object"
+		return obj, pos
+	}
+	return obj, nil
+}
+
+// Assigns the arguments of call to the stored values in the order they are
+// read by ScriptIDS.args
+func (ids *ScriptIDS) compileArgs(call *ScriptCall, entry *IdsEntry, objs []*BcsObject, ints []*int, point []*int, strs []*string) error {
+	if len(call.Args) != len(entry.Args) {
+		return ScriptError{Line: call.Line, Column: call.Column,
+			Msg: fmt.Sprintf("%s takes %d arguments, found %d", entry.Name, len(entry.Args), len(call.Args))}
+	}
+	var last *string
+	for idx, arg := range call.Args {
+		expected := entry.Args[idx]
+		mismatch := ScriptError{Line: arg.Line, Column: arg.Column, Msg: fmt.Sprintf("argument %d of %s must be ", idx+1, entry.Name)}
+		call.Args[idx].Type = expected.Type
+		switch expected.Type {
+		case IDS_OBJECT:
+			obj, err := ids.compileObject(arg)
+			if err != nil {
+				return err
+			}
+			if len(objs) == 0 {
+				mismatch.Msg = fmt.Sprintf("%s has too many object arguments", entry.Name)
+				return mismatch
+			}
+			*objs[0], objs = obj, objs[1:]
+		case IDS_INT:
+			v := arg.Int
+			if arg.Kind == SCRIPT_ARG_SYMBOL {
+				var ok bool
+				if v, ok = ids.symbol(expected.Specifics, arg.Str); !ok {
+					mismatch.Msg = fmt.Sprintf("unknown %s symbol %s%s", expected.Specifics, arg.Str, ids.Symbols[strings.ToLower(expected.Specifics)].suggest(arg.Str))
+					return mismatch
+				}
+			} else if arg.Kind != SCRIPT_ARG_INT {
+				mismatch.Msg += "an integer"
+				return mismatch
+			}
+			if len(ints) == 0 {
+				mismatch.Msg = fmt.Sprintf("%s has too many integer arguments", entry.Name)
+				return mismatch
+			}
+			*ints[0], ints = v, ints[1:]
+		case IDS_POINT:
+			if arg.Kind != SCRIPT_ARG_LIST || len(arg.Fields) != 2 || len(point) < 2 {
+				mismatch.Msg += "a point"
+				return mismatch
+			}
+			for i := range arg.Fields {
+				v, err := strconv.Atoi(arg.Fields[i])
+				if err != nil {
+					mismatch.Msg += "a point"
+					return mismatch
+				}
+				*point[i] = v
+			}
+		case IDS_STRING:
+			if arg.Kind != SCRIPT_ARG_STRING {
+				mismatch.Msg += "a string"
+				return mismatch
+			}
+			if idx > 0 && strings.EqualFold(expected.Name, "Area") && entry.Args[idx-1].Type == IDS_STRING {
+				if len(arg.Str) > 6 {
+					mismatch.Msg = fmt.Sprintf("area %q is longer than 6 characters", arg.Str)
+					return mismatch
+				}
+				*last = arg.Str + *last
+				continue
+			}
+			if len(strs) == 0 {
+				mismatch.Msg = fmt.Sprintf("%s has too many string arguments", entry.Name)
+				return mismatch
+			}
+			*strs[0], last, strs = arg.Str, strs[0], strs[1:]
+		default:
+			mismatch.Msg = fmt.Sprintf("%s cannot be compiled", entry.Name)
+			return mismatch
+		}
+	}
+	return nil
+}
+
+func (ids *ScriptIDS) compileTrigger(call *ScriptCall) (BcsTrigger, error) {
+	trig := BcsTrigger{}
+	entry := ids.Trigger.ByName(call.Name)
+	if entry == nil {
+		return trig, ScriptError{Line: call.Line, Column: call.Column, Msg: fmt.Sprintf("unknown trigger %s%s", call.Name, ids.Trigger.suggest(call.Name))}
+	}
+	trig.Id = entry.Id
+	call.Name = entry.Name
+	if call.Negated {
+		trig.Flags = 1
+	}
+	point := make([]int, 2)
+	err := ids.compileArgs(call, entry, []*BcsObject{&trig.Object}, []*int{&trig.Int1, &trig.Int2, &trig.Int3},
+		[]*int{&point[0], &point[1]}, []*string{&trig.Str1, &trig.Str2})
+	for _, arg := range entry.Args {
+		if arg.Type == IDS_POINT {
+			trig.Point = point
+		}
+	}
+	return trig, err
+}
+
+func (ids *ScriptIDS) compileAction(call *ScriptCall) (BcsAction, error) {
+	act := BcsAction{}
+	if call.Negated {
+		return act, ScriptError{Line: call.Line, Column: call.Column, Msg: "actions cannot be negated"}
+	}
+	if strings.EqualFold(call.Name, "ActionOverride") {
+		if len(call.Args) != 2 || call.Args[1].Kind != SCRIPT_ARG_CALL {
+			return act, ScriptError{Line: call.Line, Column: call.Column, Msg: "ActionOverride takes an object and an action"}
+		}
+		actor, err := ids.compileObject(call.Args[0])
+		if err != nil {
+			return act, err
+		}
+		if act, err = ids.compileAction(call.Args[1].Call); err != nil {
+			return act, err
+		}
+		act.Objects[0] = actor
+		call.Name = "ActionOverride"
+		call.Args[0].Type = IDS_OBJECT
+		call.Args[1].Type = IDS_ACTION
+		return act, nil
+	}
+	entry := ids.Action.ByName(call.Name)
+	if entry == nil {
+		return act, ScriptError{Line: call.Line, Column: call.Column, Msg: fmt.Sprintf("unknown action %s%s", call.Name, ids.Action.suggest(call.Name))}
+	}
+	act.Id = entry.Id
+	call.Name = entry.Name
+	err := ids.compileArgs(call, entry, []*BcsObject{&act.Objects[1], &act.Objects[2]}, []*int{&act.Int1, &act.Int2, &act.Int3},
+		[]*int{&act.Point[0], &act.Point[1]}, []*string{&act.Str1, &act.Str2})
+	return act, err
+}
+
+type bafResponse struct {
+	Weight  int
+	Actions []*ScriptCall
+}
+
+type bafBlock struct {
+	Line      int
+	Triggers  []*ScriptCall
+	Responses []bafResponse
+}
+
+func (p *bafParser) block() (bafBlock, error) {
+	block := bafBlock{Line: p.peek().Line}
+	if err := p.expectKeyword("IF"); err != nil {
+		return block, err
+	}
+	for !p.isKeyword("THEN") {
+		call, err := p.call()
+		if err != nil {
+			return block, err
+		}
+		block.Triggers = append(block.Triggers, call)
+	}
+	p.next()
+	for p.isKeyword("RESPONSE") {
+		p.next()
+		if err := p.expectPunct("#"); err != nil {
+			return block, err
+		}
+		tok := p.next()
+		if tok.Kind != bafTokInt {
+			return block, tok.errorf("expected response weight")
+		}
+		resp := bafResponse{}
+		resp.Weight, _ = strconv.Atoi(tok.Text)
+		for !p.isKeyword("RESPONSE") && !p.isKeyword("END") {
+			call, err := p.call()
+			if err != nil {
+				return block, err
+			}
+			resp.Actions = append(resp.Actions, call)
+		}
+		block.Responses = append(block.Responses, resp)
+	}
+	return block, p.expectKeyword("END")
+}
+
+func parseBaf(r io.Reader) ([]bafBlock, error) {
+	src, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	tokens, err := bafTokenize(string(src), 1)
+	if err != nil {
+		return nil, err
+	}
+	p := &bafParser{tokens: tokens}
+	blocks := []bafBlock{}
+	for p.peek().Kind != bafTokEOF {
+		block, err := p.block()
+		if err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, block)
+	}
+	return blocks, nil
+}
+
+func (ids *ScriptIDS) compileBlock(block bafBlock) (BcsBlock, error) {
+	out := BcsBlock{}
+	for _, call := range block.Triggers {
+		trig, err := ids.compileTrigger(call)
+		if err != nil {
+			return out, err
+		}
+		out.Triggers = append(out.Triggers, trig)
+	}
+	for _, resp := range block.Responses {
+		compiled := BcsResponse{Weight: resp.Weight}
+		for _, call := range resp.Actions {
+			act, err := ids.compileAction(call)
+			if err != nil {
+				return out, err
+			}
+			compiled.Actions = append(compiled.Actions, act)
+		}
+		out.Responses = append(out.Responses, compiled)
+	}
+	return out, nil
+}
+
+// Compiles BAF source to a script, errors are ScriptErrors giving the line
+// of the unknown name or mismatched argument
+func CompileBaf(r io.Reader, ids *ScriptIDS) (*BCS, error) {
+	blocks, err := parseBaf(r)
+	if err != nil {
+		return nil, err
+	}
+	bcs := &BCS{}
+	for _, block := range blocks {
+		compiled, err := ids.compileBlock(block)
+		if err != nil {
+			return nil, err
+		}
+		bcs.Blocks = append(bcs.Blocks, compiled)
+	}
+	return bcs, nil
+}
+
+func (obj *BcsObject) write(b *bytes.Buffer) {
+	b.WriteString("OB\n")
+	for _, v := range []int{obj.EA, obj.General, obj.Race, obj.Class, obj.Specific, obj.Gender, obj.Alignment} {
+		fmt.Fprintf(b, "%d ", v)
+	}
+	for _, v := range obj.Identifiers {
+		fmt.Fprintf(b, "%d ", v)
+	}
+	for _, v := range obj.Extra {
+		fmt.Fprintf(b, "%d ", v)
+	}
+	if obj.Rect != nil {
+		fmt.Fprintf(b, "[%s] ", joinInts(obj.Rect, "."))
+	}
+	fmt.Fprintf(b, "\"%s\"OB\n", obj.Name)
+}
+
+func joinInts(values []int, sep string) string {
+	strs := make([]string, len(values))
+	for idx, v := range values {
+		strs[idx] = strconv.Itoa(v)
+	}
+	return strings.Join(strs, sep)
+}
+
+func (bcs *BCS) Write(w io.Writer) error {
+	var b bytes.Buffer
+	b.WriteString("SC\n")
+	for _, block := range bcs.Blocks {
+		b.WriteString("CR\nCO\n")
+		for _, trig := range block.Triggers {
+			fmt.Fprintf(&b, "TR\n%d %d %d %d %d ", trig.Id, trig.Int1, trig.Flags, trig.Int2, trig.Int3)
+			if trig.Point != nil {
+				fmt.Fprintf(&b, "[%s] ", joinInts(trig.Point, ","))
+			}
+			fmt.Fprintf(&b, "\"%s\" \"%s\" ", trig.Str1, trig.Str2)
+			trig.Object.write(&b)
+			b.WriteString("TR\n")
+		}
+		b.WriteString("CO\nRS\n")
+		for _, resp := range block.Responses {
+			fmt.Fprintf(&b, "RE\n%d ", resp.Weight)
+			for _, act := range resp.Actions {
+				fmt.Fprintf(&b, "AC\n%d", act.Id)
+				for idx := range act.Objects {
+					act.Objects[idx].write(&b)
+				}
+				fmt.Fprintf(&b, "%d %d %d %d %d\"%s\" \"%s\" AC\n", act.Int1, act.Point[0], act.Point[1], act.Int2, act.Int3, act.Str1, act.Str2)
+			}
+			b.WriteString("RE\n")
+		}
+		b.WriteString("RS\nCR\n")
+	}
+	b.WriteString("SC\n")
+	_, err := w.Write(b.Bytes())
+	return err
+}
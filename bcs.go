@@ -0,0 +1,610 @@
+package bg
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// Object specifiers in the order they are stored, the identifiers hold up to
+// five object.ids functions with the innermost first.  Rect is only present
+// in Enhanced Edition scripts and Extra holds the integers some games store
+// after the identifiers.
+type BcsObject struct {
+	EA          int
+	General     int
+	Race        int
+	Class       int
+	Specific    int
+	Gender      int
+	Alignment   int
+	Identifiers [5]int
+	Extra       []int
+	Rect        []int
+	Name        string
+}
+
+// Flags bit 0 negates the trigger.  Point is only present in Enhanced Edition
+// scripts.
+type BcsTrigger struct {
+	Id     int
+	Int1   int
+	Flags  int
+	Int2   int
+	Int3   int
+	Point  []int
+	Str1   string
+	Str2   string
+	Object BcsObject
+}
+
+// Objects[0] is the actor of ActionOverride, the other two are the object
+// arguments of the action
+type BcsAction struct {
+	Id      int
+	Objects [3]BcsObject
+	Int1    int
+	Point   [2]int
+	Int2    int
+	Int3    int
+	Str1    string
+	Str2    string
+}
+
+type BcsResponse struct {
+	Weight  int
+	Actions []BcsAction
+}
+
+type BcsBlock struct {
+	Triggers  []BcsTrigger
+	Responses []BcsResponse
+}
+
+type BCS struct {
+	Blocks []BcsBlock
+}
+
+// The IDS files used to name triggers, actions and objects.  Specifiers are
+// optional and hold ea, general, race, class, specific, gender and align in
+// that order.  Symbols holds the files named by integer arguments such as
+// I:Style*AStyles, keyed by lower case name.
+type ScriptIDS struct {
+	Trigger    *IDS
+	Action     *IDS
+	Object     *IDS
+	Specifiers [7]*IDS
+	Symbols    map[string]*IDS
+}
+
+var scriptSpecifierIds = []string{"ea", "general", "race", "class", "specific", "gender", "align"}
+
+// Loads the IDS files used by scripts from key, the specifier files are
+// skipped when missing
+func LoadScriptIDS(key *KEY) (*ScriptIDS, error) {
+	open := func(name string) (*IDS, error) {
+		data, err := key.OpenFile(name + ".ids")
+		if err != nil {
+			return nil, err
+		}
+		return OpenIDS(bytes.NewReader(data))
+	}
+	var err error
+	ids := &ScriptIDS{}
+	if ids.Trigger, err = open("trigger"); err != nil {
+		return nil, fmt.Errorf("trigger.ids: %v", err)
+	}
+	if ids.Action, err = open("action"); err != nil {
+		return nil, fmt.Errorf("action.ids: %v", err)
+	}
+	if ids.Object, err = open("object"); err != nil {
+		return nil, fmt.Errorf("object.ids: %v", err)
+	}
+	for idx, name := range scriptSpecifierIds {
+		ids.Specifiers[idx], _ = open(name)
+	}
+	ids.Symbols = make(map[string]*IDS)
+	for _, file := range []*IDS{ids.Trigger, ids.Action} {
+		for _, entry := range file.Entries {
+			for _, arg := range entry.Args {
+				name := strings.ToLower(arg.Specifics)
+				if _, ok := ids.Symbols[name]; !ok && arg.Type == IDS_INT && name != "" {
+					ids.Symbols[name], _ = open(name)
+				}
+			}
+		}
+	}
+	return ids, nil
+}
+
+func (ids *ScriptIDS) symbol(file string, name string) (int, bool) {
+	symbols := ids.Symbols[strings.ToLower(file)]
+	if symbols == nil {
+		return 0, false
+	}
+	return symbols.value(name)
+}
+
+func (ids *ScriptIDS) symbolName(file string, value int) (string, bool) {
+	if entry := ids.Symbols[strings.ToLower(file)].ByID(value); entry != nil {
+		return entry.Name, true
+	}
+	return "", false
+}
+
+const (
+	bcsTokEOF = iota
+	bcsTokMarker
+	bcsTokInt
+	bcsTokString
+	bcsTokList
+)
+
+type bcsToken struct {
+	Kind  int
+	Text  string
+	Value int
+	List  []int
+}
+
+type bcsReader struct {
+	data []byte
+	pos  int
+}
+
+func isBcsDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func (r *bcsReader) next() (bcsToken, error) {
+	for r.pos < len(r.data) && strings.IndexByte(" \t\r\n", r.data[r.pos]) >= 0 {
+		r.pos++
+	}
+	if r.pos >= len(r.data) {
+		return bcsToken{Kind: bcsTokEOF}, nil
+	}
+	start := r.pos
+	c := r.data[r.pos]
+	switch {
+	case c == '"':
+		end := bytes.IndexByte(r.data[start+1:], '"')
+		if end < 0 {
+			return bcsToken{}, fmt.Errorf("Unterminated string at offset %d", start)
+		}
+		r.pos = start + end + 2
+		return bcsToken{Kind: bcsTokString, Text: string(r.data[start+1 : start+1+end])}, nil
+	case c == '[':
+		end := bytes.IndexByte(r.data[start:], ']')
+		if end < 0 {
+			return bcsToken{}, fmt.Errorf("Unterminated list at offset %d", start)
+		}
+		r.pos = start + end + 1
+		tok := bcsToken{Kind: bcsTokList, Text: string(r.data[start:r.pos])}
+		for _, field := range strings.FieldsFunc(tok.Text[1:len(tok.Text)-1], func(c rune) bool { return c == '.' || c == ',' }) {
+			v, err := strconv.Atoi(strings.TrimSpace(field))
+			if err != nil {
+				return bcsToken{}, fmt.Errorf("Bad list %s at offset %d", tok.Text, start)
+			}
+			tok.List = append(tok.List, v)
+		}
+		return tok, nil
+	case c == '-' || isBcsDigit(c):
+		r.pos++
+		for r.pos < len(r.data) && isBcsDigit(r.data[r.pos]) {
+			r.pos++
+		}
+		v, err := strconv.Atoi(string(r.data[start:r.pos]))
+		if err != nil {
+			return bcsToken{}, fmt.Errorf("Bad number at offset %d: %v", start, err)
+		}
+		return bcsToken{Kind: bcsTokInt, Value: v}, nil
+	case r.pos+1 < len(r.data):
+		r.pos += 2
+		return bcsToken{Kind: bcsTokMarker, Text: string(r.data[start:r.pos])}, nil
+	}
+	return bcsToken{}, fmt.Errorf("Unexpected %q at offset %d", c, start)
+}
+
+func (r *bcsReader) peek() (bcsToken, error) {
+	pos := r.pos
+	tok, err := r.next()
+	r.pos = pos
+	return tok, err
+}
+
+func (r *bcsReader) expect(marker string) error {
+	tok, err := r.next()
+	if err != nil {
+		return err
+	}
+	if tok.Kind != bcsTokMarker || tok.Text != marker {
+		return fmt.Errorf("Expected %s before offset %d", marker, r.pos)
+	}
+	return nil
+}
+
+// Reads integers up to count, stopping early at anything else
+func (r *bcsReader) ints(count int) ([]int, error) {
+	values := []int{}
+	for len(values) < count {
+		tok, err := r.peek()
+		if err != nil {
+			return nil, err
+		}
+		if tok.Kind != bcsTokInt {
+			break
+		}
+		r.next()
+		values = append(values, tok.Value)
+	}
+	return values, nil
+}
+
+func (r *bcsReader) str() (string, error) {
+	tok, err := r.next()
+	if err != nil {
+		return "", err
+	}
+	if tok.Kind != bcsTokString {
+		return "", fmt.Errorf("Expected string before offset %d", r.pos)
+	}
+	return tok.Text, nil
+}
+
+func (r *bcsReader) object() (BcsObject, error) {
+	obj := BcsObject{}
+	if err := r.expect("OB"); err != nil {
+		return obj, err
+	}
+	values, err := r.ints(64)
+	if err != nil {
+		return obj, err
+	}
+	tok, err := r.peek()
+	if err != nil {
+		return obj, err
+	}
+	if tok.Kind == bcsTokList {
+		r.next()
+		obj.Rect = tok.List
+	}
+	if obj.Name, err = r.str(); err != nil {
+		return obj, err
+	}
+	if len(values) < 12 {
+		return obj, fmt.Errorf("Object has %d fields before offset %d", len(values), r.pos)
+	}
+	fields := []*int{&obj.EA, &obj.General, &obj.Race, &obj.Class, &obj.Specific, &obj.Gender, &obj.Alignment}
+	for idx, field := range fields {
+		*field = values[idx]
+	}
+	copy(obj.Identifiers[:], values[7:12])
+	if len(values) > 12 {
+		obj.Extra = values[12:]
+	}
+	return obj, r.expect("OB")
+}
+
+func (r *bcsReader) trigger() (BcsTrigger, error) {
+	trig := BcsTrigger{}
+	values, err := r.ints(5)
+	if err != nil {
+		return trig, err
+	}
+	if len(values) != 5 {
+		return trig, fmt.Errorf("Trigger has %d fields before offset %d", len(values), r.pos)
+	}
+	trig.Id, trig.Int1, trig.Flags, trig.Int2, trig.Int3 = values[0], values[1], values[2], values[3], values[4]
+	tok, err := r.peek()
+	if err != nil {
+		return trig, err
+	}
+	if tok.Kind == bcsTokList {
+		r.next()
+		trig.Point = tok.List
+	}
+	if trig.Str1, err = r.str(); err != nil {
+		return trig, err
+	}
+	if trig.Str2, err = r.str(); err != nil {
+		return trig, err
+	}
+	if trig.Object, err = r.object(); err != nil {
+		return trig, err
+	}
+	return trig, r.expect("TR")
+}
+
+func (r *bcsReader) action() (BcsAction, error) {
+	act := BcsAction{}
+	values, err := r.ints(1)
+	if err != nil {
+		return act, err
+	}
+	if len(values) != 1 {
+		return act, fmt.Errorf("Action without id before offset %d", r.pos)
+	}
+	act.Id = values[0]
+	for idx := range act.Objects {
+		if act.Objects[idx], err = r.object(); err != nil {
+			return act, err
+		}
+	}
+	if values, err = r.ints(5); err != nil {
+		return act, err
+	}
+	if len(values) != 5 {
+		return act, fmt.Errorf("Action has %d fields before offset %d", len(values), r.pos)
+	}
+	act.Int1, act.Point[0], act.Point[1], act.Int2, act.Int3 = values[0], values[1], values[2], values[3], values[4]
+	if act.Str1, err = r.str(); err != nil {
+		return act, err
+	}
+	if act.Str2, err = r.str(); err != nil {
+		return act, err
+	}
+	return act, r.expect("AC")
+}
+
+func (r *bcsReader) block() (BcsBlock, error) {
+	block := BcsBlock{}
+	if err := r.expect("CO"); err != nil {
+		return block, err
+	}
+	for {
+		tok, err := r.next()
+		if err != nil {
+			return block, err
+		}
+		if tok.Kind == bcsTokMarker && tok.Text == "CO" {
+			break
+		}
+		if tok.Kind != bcsTokMarker || tok.Text != "TR" {
+			return block, fmt.Errorf("Expected TR before offset %d", r.pos)
+		}
+		trig, err := r.trigger()
+		if err != nil {
+			return block, err
+		}
+		block.Triggers = append(block.Triggers, trig)
+	}
+
+	if err := r.expect("RS"); err != nil {
+		return block, err
+	}
+	for {
+		tok, err := r.next()
+		if err != nil {
+			return block, err
+		}
+		if tok.Kind == bcsTokMarker && tok.Text == "RS" {
+			break
+		}
+		if tok.Kind != bcsTokMarker || tok.Text != "RE" {
+			return block, fmt.Errorf("Expected RE before offset %d", r.pos)
+		}
+		values, err := r.ints(1)
+		if err != nil {
+			return block, err
+		}
+		if len(values) != 1 {
+			return block, fmt.Errorf("Response without weight before offset %d", r.pos)
+		}
+		resp := BcsResponse{Weight: values[0]}
+		for {
+			tok, err := r.next()
+			if err != nil {
+				return block, err
+			}
+			if tok.Kind == bcsTokMarker && tok.Text == "RE" {
+				break
+			}
+			if tok.Kind != bcsTokMarker || tok.Text != "AC" {
+				return block, fmt.Errorf("Expected AC before offset %d", r.pos)
+			}
+			act, err := r.action()
+			if err != nil {
+				return block, err
+			}
+			resp.Actions = append(resp.Actions, act)
+		}
+		block.Responses = append(block.Responses, resp)
+	}
+	return block, r.expect("CR")
+}
+
+func OpenBCS(r io.Reader) (*BCS, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	reader := &bcsReader{data: Decrypt(data)}
+	bcs := &BCS{}
+	if err = reader.expect("SC"); err != nil {
+		return nil, err
+	}
+	for {
+		tok, err := reader.next()
+		if err != nil {
+			return nil, err
+		}
+		if tok.Kind == bcsTokMarker && tok.Text == "SC" {
+			break
+		}
+		if tok.Kind != bcsTokMarker || tok.Text != "CR" {
+			return nil, fmt.Errorf("Expected CR before offset %d", reader.pos)
+		}
+		block, err := reader.block()
+		if err != nil {
+			return nil, err
+		}
+		bcs.Blocks = append(bcs.Blocks, block)
+	}
+	return bcs, nil
+}
+
+func (obj *BcsObject) isEmpty() bool {
+	if obj.Name != "" || len(obj.Extra) > 0 {
+		return false
+	}
+	for _, v := range []int{obj.EA, obj.General, obj.Race, obj.Class, obj.Specific, obj.Gender, obj.Alignment} {
+		if v != 0 {
+			return false
+		}
+	}
+	return obj.Identifiers == [5]int{}
+}
+
+func idsName(ids *IDS, id int) string {
+	if entry := ids.ByID(id); entry != nil {
+		return entry.Name
+	}
+	return strconv.Itoa(id)
+}
+
+func (ids *ScriptIDS) object(obj BcsObject) string {
+	if obj.Name != "" {
+		return strconv.Quote(obj.Name)
+	}
+	fields := []int{obj.EA, obj.General, obj.Race, obj.Class, obj.Specific, obj.Gender, obj.Alignment}
+	last := -1
+	for idx, v := range fields {
+		if v != 0 {
+			last = idx
+		}
+	}
+	out := ""
+	if last >= 0 || obj.Identifiers == [5]int{} {
+		names := []string{}
+		for idx := 0; idx <= last || idx == 0; idx++ {
+			names = append(names, idsName(ids.Specifiers[idx], fields[idx]))
+		}
+		out = "[" + strings.Join(names, ".") + "]"
+	}
+	for _, id := range obj.Identifiers {
+		if id == 0 {
+			continue
+		}
+		name := idsName(ids.Object, id)
+		if out == "" {
+			out = name
+		} else {
+			out = name + "(" + out + ")"
+		}
+	}
+	return out
+}
+
+func bafString(str string) string {
+	if strings.Contains(str, "\"") {
+		return "~" + str + "~"
+	}
+	return "\"" + str + "\""
+}
+
+// Renders the arguments of entry taking the values in the order they are
+// stored.  A S:Area argument following another string shares its stored
+// string, the scope taking the first six characters.
+func (ids *ScriptIDS) args(entry *IdsEntry, objs []BcsObject, ints []int, point []int, strs []string) string {
+	args := []string{}
+	for idx, arg := range entry.Args {
+		switch arg.Type {
+		case IDS_OBJECT:
+			obj := BcsObject{}
+			if len(objs) > 0 {
+				obj, objs = objs[0], objs[1:]
+			}
+			args = append(args, ids.object(obj))
+		case IDS_INT:
+			v := 0
+			if len(ints) > 0 {
+				v, ints = ints[0], ints[1:]
+			}
+			if name, ok := ids.symbolName(arg.Specifics, v); ok {
+				args = append(args, name)
+			} else {
+				args = append(args, strconv.Itoa(v))
+			}
+		case IDS_POINT:
+			if len(point) >= 2 {
+				args = append(args, fmt.Sprintf("[%d.%d]", point[0], point[1]))
+			} else {
+				args = append(args, "[0.0]")
+			}
+		case IDS_STRING:
+			if idx > 0 && strings.EqualFold(arg.Name, "Area") && entry.Args[idx-1].Type == IDS_STRING {
+				prev := args[len(args)-1]
+				prev = prev[1 : len(prev)-1]
+				area := prev
+				if len(area) > 6 {
+					area = area[:6]
+				}
+				args[len(args)-1] = bafString(prev[len(area):])
+				args = append(args, bafString(area))
+				continue
+			}
+			str := ""
+			if len(strs) > 0 {
+				str, strs = strs[0], strs[1:]
+			}
+			args = append(args, bafString(str))
+		}
+	}
+	return strings.Join(args, ",")
+}
+
+func (ids *ScriptIDS) trigger(trig BcsTrigger) (string, error) {
+	entry := ids.Trigger.ByID(trig.Id)
+	if entry == nil {
+		return "", fmt.Errorf("Unknown trigger 0x%04x", trig.Id)
+	}
+	out := entry.Name + "(" + ids.args(entry, []BcsObject{trig.Object}, []int{trig.Int1, trig.Int2, trig.Int3}, trig.Point, []string{trig.Str1, trig.Str2}) + ")"
+	if trig.Flags&1 != 0 {
+		out = "!" + out
+	}
+	return out, nil
+}
+
+func (ids *ScriptIDS) action(act BcsAction) (string, error) {
+	entry := ids.Action.ByID(act.Id)
+	if entry == nil {
+		return "", fmt.Errorf("Unknown action %d", act.Id)
+	}
+	out := entry.Name + "(" + ids.args(entry, act.Objects[1:], []int{act.Int1, act.Int2, act.Int3}, act.Point[:], []string{act.Str1, act.Str2}) + ")"
+	if !act.Objects[0].isEmpty() {
+		out = "ActionOverride(" + ids.object(act.Objects[0]) + "," + out + ")"
+	}
+	return out, nil
+}
+
+// Decompiles the script to BAF
+func (bcs *BCS) WriteBaf(w io.Writer, ids *ScriptIDS) error {
+	var b bytes.Buffer
+	for _, block := range bcs.Blocks {
+		b.WriteString("IF\n")
+		for _, trig := range block.Triggers {
+			str, err := ids.trigger(trig)
+			if err != nil {
+				return err
+			}
+			b.WriteString("  " + str + "\n")
+		}
+		b.WriteString("THEN\n")
+		for _, resp := range block.Responses {
+			fmt.Fprintf(&b, "  RESPONSE #%d\n", resp.Weight)
+			for _, act := range resp.Actions {
+				str, err := ids.action(act)
+				if err != nil {
+					return err
+				}
+				b.WriteString("    " + str + "\n")
+			}
+		}
+		b.WriteString("END\n\n")
+	}
+	_, err := w.Write(b.Bytes())
+	return err
+}
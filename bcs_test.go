@@ -0,0 +1,228 @@
+package bg
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func newTestScriptIDS(t *testing.T) *ScriptIDS {
+	open := func(src string) *IDS {
+		ids, err := OpenIDS(strings.NewReader(src))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ids
+	}
+	return &ScriptIDS{
+		Trigger: open("IDS V1.0\n0x400F Global(S:Name*,S:Area*,I:Value*)\n0x4063 See(O:Object*)\n0x0020 HitBy(O:Object*,I:Style*AStyles)\n0x4002 True()\n"),
+		Action:  open("IDS V1.0\n30 SetGlobal(S:Name*,S:Area*,I:Value*)\n3 Attack(O:Target*)\n1 ActionOverride(O:Actor*,A:Action*)\n36 Continue()\n137 StartDialog(S:DialogFile*,O:Target*)\n"),
+		Object:  open("IDS V1.0\n1 Myself\n14 NearestEnemyOf\n"),
+		Specifiers: [7]*IDS{
+			open("IDS V1.0\n0 ANYONE\n255 ENEMY\n"),
+		},
+		Symbols: map[string]*IDS{
+			"astyles": open("IDS V1.0\n0 CRUSHING\n1 PIERCING\n"),
+		},
+	}
+}
+
+// Laid out exactly as the game compiler writes scripts
+const testBcs = `SC
+CR
+CO
+TR
+16399 0 0 0 0 "GLOBALMyVar" "" OB
+0 0 0 0 0 0 0 0 0 0 0 0 ""OB
+TR
+TR
+16483 0 1 0 0 "" "" OB
+0 0 0 0 0 0 0 1 14 0 0 0 ""OB
+TR
+CO
+RS
+RE
+100 AC
+30OB
+0 0 0 0 0 0 0 0 0 0 0 0 ""OB
+OB
+0 0 0 0 0 0 0 0 0 0 0 0 ""OB
+OB
+0 0 0 0 0 0 0 0 0 0 0 0 ""OB
+1 0 0 0 0"LOCALSDone" "" AC
+AC
+3OB
+0 0 0 0 0 0 0 0 0 0 0 0 "Imoen"OB
+OB
+255 0 0 0 0 0 0 0 0 0 0 0 ""OB
+OB
+0 0 0 0 0 0 0 0 0 0 0 0 ""OB
+0 0 0 0 0"" "" AC
+RE
+RS
+CR
+SC
+`
+
+func TestOpenBCS(t *testing.T) {
+	bcs, err := OpenBCS(strings.NewReader(testBcs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bcs.Blocks) != 1 || len(bcs.Blocks[0].Triggers) != 2 || len(bcs.Blocks[0].Responses[0].Actions) != 2 {
+		t.Fatalf("Bad script: %+v", bcs)
+	}
+	var buf bytes.Buffer
+	if err = bcs.WriteBaf(&buf, newTestScriptIDS(t)); err != nil {
+		t.Fatal(err)
+	}
+	expected := `IF
+  Global("MyVar","GLOBAL",0)
+  !See(NearestEnemyOf(Myself))
+THEN
+  RESPONSE #100
+    SetGlobal("Done","LOCALS",1)
+    ActionOverride("Imoen",Attack([ENEMY]))
+END
+
+`
+	if buf.String() != expected {
+		t.Errorf("Bad BAF:\n%s", buf.String())
+	}
+
+	if _, err = OpenBCS(strings.NewReader("SC\nCR\nCO\nTR\n1 0 0 \"\" \"\"")); err == nil {
+		t.Errorf("Expected error for truncated script")
+	}
+}
+
+func TestCompileBaf(t *testing.T) {
+	ids := newTestScriptIDS(t)
+	src := `// comment
+IF
+  Global("MyVar","GLOBAL",0)
+  !See(NearestEnemyOf(Myself))
+THEN
+  RESPONSE #100
+    SetGlobal("Done","LOCALS",1)
+    ActionOverride("Imoen",Attack([ENEMY]))
+END
+`
+	bcs, err := CompileBaf(strings.NewReader(src), ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err = bcs.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != testBcs {
+		t.Errorf("Bad BCS:\n%s\nexpected:\n%s", buf.String(), testBcs)
+	}
+
+	errors := []struct {
+		src  string
+		line int
+	}{
+		{"IF\n  Truth()\nTHEN\nEND\n", 2},
+		{"IF\nTHEN\n  RESPONSE #100\n    SetGlobal(\"a\",\"GLOBAL\",\"b\")\nEND\n", 4},
+		{"IF\n  See(\"a\",1)\nTHEN\nEND\n", 2},
+		{"IF\n  See(Nobody)\nTHEN\nEND\n", 2},
+	}
+	for _, test := range errors {
+		_, err := CompileBaf(strings.NewReader(test.src), ids)
+		if scriptErr, ok := err.(ScriptError); !ok || scriptErr.Line != test.line {
+			t.Errorf("Expected error on line %d for %q, got %v", test.line, test.src, err)
+		}
+	}
+}
+
+func TestParseScript(t *testing.T) {
+	ids := newTestScriptIDS(t)
+	triggers, err := ParseTriggers("global(\"X\",\"GLOBAL\",1)\r\n  !See(NearestEnemyOf(Myself))\nHitBy([ANYONE],PIERCING)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errs := ids.ValidateTriggers(triggers); len(errs) != 0 {
+		t.Fatal(errs)
+	}
+	expected := "Global(\"X\",\"GLOBAL\",1)\n!See(NearestEnemyOf(Myself))\nHitBy([ANYONE],PIERCING)"
+	if FormatScript(triggers) != expected {
+		t.Errorf("Bad format:\n%s", FormatScript(triggers))
+	}
+	arg := triggers[2].Args[1]
+	if arg.Kind != SCRIPT_ARG_SYMBOL || arg.Type != IDS_INT || triggers[1].Args[0].Type != IDS_OBJECT {
+		t.Errorf("Bad argument types: %+v", triggers[2].Args)
+	}
+
+	bcs := &BCS{Blocks: []BcsBlock{{}}}
+	trig, _ := ids.compileTrigger(triggers[2])
+	if trig.Int1 != 1 {
+		t.Errorf("Symbol not compiled: %+v", trig)
+	}
+	bcs.Blocks[0].Triggers = append(bcs.Blocks[0].Triggers, trig)
+	var buf bytes.Buffer
+	if err = bcs.WriteBaf(&buf, ids); err != nil || !strings.Contains(buf.String(), "HitBy([ANYONE],PIERCING)") {
+		t.Errorf("Symbol not decompiled: %s %v", buf.String(), err)
+	}
+
+	actions, err := ParseActions("SetGlobal(\"X\",\"GLOBAL\",2)\nAttack(Nobody)\nJump()")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errs := ids.ValidateActions(actions); len(errs) != 2 || errs[0].(ScriptError).Line != 2 || errs[1].(ScriptError).Line != 3 {
+		t.Errorf("Bad errors: %v", errs)
+	}
+	if _, err = ParseActions("!SetGlobal(\"X\",\"GLOBAL\",2)"); err == nil {
+		t.Errorf("Expected error for negated action")
+	}
+}
+
+func TestLint(t *testing.T) {
+	linter := NewLinter(newTestScriptIDS(t), nil)
+	src := `IF
+  True()
+THEN
+  RESPONSE #100
+    Continue()
+    StartDialog("TOOLONGNAME",[ENEMu])
+END
+
+IF
+  True()
+THEN
+  RESPONSE #100
+    Attack(NearestEnemyOf(Myself))
+END
+
+IF
+  Sees(Myself)
+THEN
+  RESPONSE #100
+    Attack(Myself)
+END
+`
+	issues := linter.LintBaf("TEST.BAF", strings.NewReader(src))
+	expected := []string{
+		"TEST.BAF:5:5: warning: Continue() should be the last action of the response",
+		"TEST.BAF:6:31: error: unknown ea ENEMu, did you mean ENEMY?",
+		"TEST.BAF:9:1: warning: block is always true and has no Continue(), the blocks after it never run",
+		"TEST.BAF:17:3: error: unknown trigger Sees, did you mean See?",
+	}
+	if len(issues) != len(expected) {
+		t.Fatalf("Bad issues: %v", issues)
+	}
+	for idx, issue := range issues {
+		if issue.String() != expected[idx] {
+			t.Errorf("Bad issue %d: %s", idx, issue.String())
+		}
+	}
+
+	dlg := &DLG{
+		StateTriggers: []string{"See(Myself)", "See(Myself"},
+		Actions:       []string{"StartDialog(\"TOOLONGNAME\",Myself)"},
+	}
+	issues = linter.LintDlg("TEST.DLG", dlg)
+	if len(issues) != 2 || issues[0].Source != "TEST.DLG state trigger 1" || issues[1].Source != "TEST.DLG action 0" || issues[1].Severity != LINT_ERROR {
+		t.Errorf("Bad dialog issues: %v", issues)
+	}
+}
@@ -0,0 +1,37 @@
+package bg
+
+// Text resources may be obscured by xoring them with this key, such files
+// start with 0xFF 0xFF
+var xorKey = []byte{
+	0x88, 0xa8, 0x8f, 0xba, 0x8a, 0xd3, 0xb9, 0xf5, 0xed, 0xb1, 0xcf, 0xea, 0xaa, 0xe4, 0xb5, 0xfb,
+	0xeb, 0x82, 0xf9, 0x90, 0xca, 0xc9, 0xb5, 0xe7, 0xdc, 0x8e, 0xb7, 0xac, 0xee, 0xf7, 0xe0, 0xca,
+	0x8e, 0xea, 0xca, 0x80, 0xce, 0xc5, 0xad, 0xb7, 0xc4, 0xd0, 0x84, 0x93, 0xd5, 0xf0, 0xeb, 0xc8,
+	0xb4, 0x9d, 0xcc, 0xaf, 0xa5, 0x95, 0xba, 0x99, 0x87, 0xd2, 0x9d, 0x96, 0xb4, 0xf1, 0xda, 0x8c,
+}
+
+func IsEncrypted(data []byte) bool {
+	return len(data) >= 2 && data[0] == 0xff && data[1] == 0xff
+}
+
+// Returns data with the encryption removed, data that is not encrypted is
+// returned unchanged
+func Decrypt(data []byte) []byte {
+	if !IsEncrypted(data) {
+		return data
+	}
+	out := make([]byte, len(data)-2)
+	for idx := range out {
+		out[idx] = data[idx+2] ^ xorKey[idx%len(xorKey)]
+	}
+	return out
+}
+
+// Returns data encrypted the way the games ship some text resources
+func Encrypt(data []byte) []byte {
+	out := make([]byte, len(data)+2)
+	out[0], out[1] = 0xff, 0xff
+	for idx, c := range data {
+		out[idx+2] = c ^ xorKey[idx%len(xorKey)]
+	}
+	return out
+}
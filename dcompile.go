@@ -0,0 +1,1136 @@
+package bg
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// DError is returned when WeiDU D or TRA source cannot be compiled.
+type DError struct {
+	Line   int
+	Column int
+	Msg    string
+}
+
+func (e DError) Error() string {
+	return fmt.Sprintf("line %d, column %d: %s", e.Line, e.Column, e.Msg)
+}
+
+const (
+	D_TOK_EOF = iota
+	D_TOK_WORD
+	D_TOK_STRING
+	D_TOK_SOUND
+)
+
+type dToken struct {
+	Kind   int
+	Text   string
+	Line   int
+	Column int
+}
+
+func (tok dToken) errorf(format string, args ...interface{}) error {
+	return DError{Line: tok.Line, Column: tok.Column, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (tok dToken) is(word string) bool {
+	return tok.Kind == D_TOK_WORD && tok.Text == word
+}
+
+func (tok dToken) String() string {
+	switch tok.Kind {
+	case D_TOK_EOF:
+		return "end of file"
+	case D_TOK_STRING:
+		return dString(tok.Text)
+	case D_TOK_SOUND:
+		return "[" + tok.Text + "]"
+	}
+	return tok.Text
+}
+
+// Splits WeiDU source into words, strings and sound references, comments are
+// dropped.
+func dTokenize(src string) ([]dToken, error) {
+	tokens := []dToken{}
+	line, col := 1, 1
+	advance := func(n int) {
+		for _, c := range src[:n] {
+			if c == '\n' {
+				line++
+				col = 1
+			} else {
+				col++
+			}
+		}
+		src = src[n:]
+	}
+
+	for {
+		for len(src) > 0 && strings.ContainsRune(" \t\r\n", rune(src[0])) {
+			advance(1)
+		}
+		tok := dToken{Line: line, Column: col}
+		if len(src) == 0 {
+			tokens = append(tokens, tok)
+			return tokens, nil
+		}
+
+		switch {
+		case strings.HasPrefix(src, "//"):
+			end := strings.IndexByte(src, '\n')
+			if end < 0 {
+				end = len(src)
+			}
+			advance(end)
+			continue
+		case strings.HasPrefix(src, "/*"):
+			end := strings.Index(src, "*/")
+			if end < 0 {
+				return nil, tok.errorf("unterminated comment")
+			}
+			advance(end + 2)
+			continue
+		case strings.HasPrefix(src, "~~~~~"):
+			end := strings.Index(src[5:], "~~~~~")
+			if end < 0 {
+				return nil, tok.errorf("unterminated string")
+			}
+			tok.Kind = D_TOK_STRING
+			tok.Text = src[5 : 5+end]
+			advance(end + 10)
+		case src[0] == '~' || src[0] == '%' || src[0] == '"':
+			end := strings.IndexByte(src[1:], src[0])
+			if end < 0 {
+				return nil, tok.errorf("unterminated string")
+			}
+			tok.Kind = D_TOK_STRING
+			tok.Text = src[1 : 1+end]
+			advance(end + 2)
+		case src[0] == '[':
+			end := strings.IndexByte(src, ']')
+			if end < 0 {
+				return nil, tok.errorf("unterminated sound")
+			}
+			tok.Kind = D_TOK_SOUND
+			tok.Text = strings.TrimSpace(src[1:end])
+			advance(end + 1)
+		case strings.HasPrefix(src, "=="):
+			tok.Kind = D_TOK_WORD
+			tok.Text = "=="
+			advance(2)
+		case src[0] == '=' || src[0] == '+':
+			tok.Kind = D_TOK_WORD
+			tok.Text = src[0:1]
+			advance(1)
+		default:
+			end := 0
+			for end < len(src) && !strings.ContainsRune(" \t\r\n~%\"[=+", rune(src[end])) &&
+				!strings.HasPrefix(src[end:], "//") && !strings.HasPrefix(src[end:], "/*") {
+				end++
+			}
+			tok.Kind = D_TOK_WORD
+			tok.Text = src[:end]
+			advance(end)
+		}
+		tokens = append(tokens, tok)
+	}
+}
+
+type dTra struct {
+	Text        string
+	Sound       string
+	Female      string
+	FemaleSound string
+}
+
+type dTransition struct {
+	trigger    string
+	action     string
+	flags      uint32
+	hasReply   bool
+	reply      uint32
+	hasJournal bool
+	journal    uint32
+	nextDlg    string
+	nextLabel  string
+	copyDlg    string
+	copyLabel  string
+	tok        dToken
+}
+
+type dState struct {
+	dlg       string
+	label     string
+	trigger   string
+	hasWeight bool
+	weight    int
+	say       uint32
+	trans     []*dTransition
+	index     int
+	tok       dToken
+}
+
+type dBegin struct {
+	dlg   string
+	flags uint32
+}
+
+type dExtend struct {
+	dlg      string
+	labels   []string
+	position int
+	trans    []*dTransition
+	tok      dToken
+}
+
+type dChainLine struct {
+	dlg    string
+	cond   string
+	say    uint32
+	action string
+	label  string
+	tok    dToken
+}
+
+// DCompiler compiles WeiDU D source into DLG files, new strings are appended
+// to Talk with their female variants.  Dialogs being appended to or extended
+// must be added to Dialogs before compiling.
+type DCompiler struct {
+	Talk    *TalkTable
+	Dialogs map[string]*DLG
+
+	tra       map[int]dTra
+	strs      map[dTra]uint32
+	newStrs   []dTra
+	labels    map[string]map[string]int
+	counts    map[string]int
+	autoLabel int
+
+	tokens []dToken
+	pos    int
+	items  []interface{}
+}
+
+func NewDCompiler(talk *TalkTable) *DCompiler {
+	return &DCompiler{
+		Talk:    talk,
+		Dialogs: make(map[string]*DLG),
+		tra:     make(map[int]dTra),
+		strs:    make(map[dTra]uint32),
+	}
+}
+
+func (c *DCompiler) AddDialog(name string, dlg *DLG) {
+	c.Dialogs[strings.ToUpper(name)] = dlg
+}
+
+func (c *DCompiler) Dialog(name string) *DLG {
+	return c.Dialogs[strings.ToUpper(name)]
+}
+
+func (c *DCompiler) peek() dToken {
+	return c.tokens[c.pos]
+}
+
+func (c *DCompiler) next() dToken {
+	tok := c.tokens[c.pos]
+	if tok.Kind != D_TOK_EOF {
+		c.pos++
+	}
+	return tok
+}
+
+func (c *DCompiler) accept(word string) bool {
+	if c.peek().is(word) {
+		c.pos++
+		return true
+	}
+	return false
+}
+
+func (c *DCompiler) expect(word string) error {
+	if tok := c.next(); !tok.is(word) {
+		return tok.errorf("expected %s, found %s", word, tok)
+	}
+	return nil
+}
+
+func (c *DCompiler) expectString() (string, error) {
+	tok := c.next()
+	if tok.Kind != D_TOK_STRING {
+		return "", tok.errorf("expected string, found %s", tok)
+	}
+	return tok.Text, nil
+}
+
+func (c *DCompiler) expectWord() (dToken, error) {
+	tok := c.next()
+	if tok.Kind != D_TOK_WORD && tok.Kind != D_TOK_STRING {
+		return tok, tok.errorf("expected name, found %s", tok)
+	}
+	return tok, nil
+}
+
+func (c *DCompiler) expectName() (string, error) {
+	tok, err := c.expectWord()
+	return strings.ToUpper(tok.Text), err
+}
+
+func (c *DCompiler) expectInt() (int, error) {
+	tok := c.next()
+	num, err := strconv.ParseInt(strings.TrimPrefix(tok.Text, "#"), 0, 64)
+	if tok.Kind != D_TOK_WORD || err != nil {
+		return 0, tok.errorf("expected number, found %s", tok)
+	}
+	return int(num), nil
+}
+
+// Allocates a STRREF for str, the string is only added to the talk table by
+// addStrings once the whole source compiled
+func (c *DCompiler) addString(str dTra) (uint32, error) {
+	if id, ok := c.strs[str]; ok {
+		return id, nil
+	}
+	if c.Talk == nil {
+		return 0, fmt.Errorf("No TLK to add string to: %s", dString(str.Text))
+	}
+	id := uint32(c.Talk.GetStringCount() + len(c.newStrs))
+	c.newStrs = append(c.newStrs, str)
+	c.strs[str] = id
+	return id, nil
+}
+
+func (c *DCompiler) addStrings() {
+	for _, str := range c.newStrs {
+		id := c.Talk.GetStringCount()
+		c.Talk.AddString(id, str.Text, str.Female, str.Sound)
+		if entry, _ := c.Talk.Male.Entry(id); str.Sound != "" {
+			entry.Sound = NewResref(str.Sound)
+		}
+		if c.Talk.Female != nil && str.Female != "" && str.FemaleSound != "" {
+			entry, _ := c.Talk.Female.Entry(id)
+			entry.Sound = NewResref(str.FemaleSound)
+		}
+	}
+	c.newStrs = nil
+}
+
+func (c *DCompiler) dropStrings() {
+	for _, str := range c.newStrs {
+		delete(c.strs, str)
+	}
+	c.newStrs = nil
+}
+
+// Parses a string with its optional sound and female variant
+func (c *DCompiler) parseTra() (dTra, error) {
+	str, err := c.expectString()
+	if err != nil {
+		return dTra{}, err
+	}
+	tra := dTra{Text: str}
+	if c.peek().Kind == D_TOK_SOUND {
+		tra.Sound = c.next().Text
+	}
+	if c.peek().Kind == D_TOK_STRING {
+		tra.Female = c.next().Text
+		if c.peek().Kind == D_TOK_SOUND {
+			tra.FemaleSound = c.next().Text
+		}
+	}
+	return tra, nil
+}
+
+// Parses #strref, @tra or a literal string into a STRREF
+func (c *DCompiler) parseText() (uint32, error) {
+	tok := c.peek()
+	if tok.Kind == D_TOK_WORD && strings.HasPrefix(tok.Text, "#") {
+		num, err := c.expectInt()
+		return uint32(num), err
+	}
+	if tok.Kind == D_TOK_WORD && strings.HasPrefix(tok.Text, "@") {
+		c.next()
+		num, err := strconv.Atoi(tok.Text[1:])
+		if err != nil {
+			return 0, tok.errorf("invalid tra reference %s", tok)
+		}
+		tra, ok := c.tra[num]
+		if !ok {
+			return 0, tok.errorf("tra reference %s not found", tok)
+		}
+		id, err := c.addString(tra)
+		if err != nil {
+			return 0, tok.errorf("%s", err)
+		}
+		return id, nil
+	}
+	tra, err := c.parseTra()
+	if err != nil {
+		return 0, err
+	}
+	id, err := c.addString(tra)
+	if err != nil {
+		return 0, tok.errorf("%s", err)
+	}
+	return id, nil
+}
+
+// Loads @n = ~text~ [sound] entries used to resolve @n references
+func (c *DCompiler) LoadTra(r io.Reader) error {
+	src, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	c.tokens, err = dTokenize(string(src))
+	if err != nil {
+		return err
+	}
+	c.pos = 0
+	for c.peek().Kind != D_TOK_EOF {
+		tok := c.next()
+		num, err := strconv.Atoi(strings.TrimPrefix(tok.Text, "@"))
+		if tok.Kind != D_TOK_WORD || !strings.HasPrefix(tok.Text, "@") || err != nil {
+			return tok.errorf("expected @number, found %s", tok)
+		}
+		if err = c.expect("="); err != nil {
+			return err
+		}
+		tra, err := c.parseTra()
+		if err != nil {
+			return err
+		}
+		c.tra[num] = tra
+	}
+	return nil
+}
+
+func (c *DCompiler) newLabel() string {
+	c.autoLabel++
+	return fmt.Sprintf("\x00%d", c.autoLabel)
+}
+
+func (c *DCompiler) parseTransitionNext(t *dTransition) error {
+	tok := c.next()
+	switch {
+	case tok.is("EXIT"):
+		t.flags |= DLG_TRANS_EXIT
+	case tok.is("GOTO"), tok.is("+"):
+		label, err := c.expectWord()
+		if err != nil {
+			return err
+		}
+		t.nextLabel = label.Text
+	case tok.is("EXTERN"):
+		c.accept("IF_FILE_EXISTS")
+		name, err := c.expectName()
+		if err != nil {
+			return err
+		}
+		label, err := c.expectWord()
+		if err != nil {
+			return err
+		}
+		t.nextDlg = name
+		t.nextLabel = label.Text
+	default:
+		return tok.errorf("expected GOTO, EXTERN or EXIT, found %s", tok)
+	}
+	return nil
+}
+
+func (c *DCompiler) parseTransitionFeatures(t *dTransition) error {
+	for {
+		tok := c.peek()
+		var err error
+		switch {
+		case tok.is("REPLY"):
+			c.next()
+			t.hasReply = true
+			t.reply, err = c.parseText()
+		case tok.is("DO"):
+			c.next()
+			t.action, err = c.expectString()
+		case tok.is("JOURNAL"), tok.is("SOLVED_JOURNAL"), tok.is("UNSOLVED_JOURNAL"):
+			c.next()
+			t.hasJournal = true
+			if tok.is("SOLVED_JOURNAL") {
+				t.flags |= DLG_TRANS_SOLVED
+			} else if tok.is("UNSOLVED_JOURNAL") {
+				t.flags |= DLG_TRANS_UNSOLVED
+			}
+			t.journal, err = c.parseText()
+		case tok.is("FLAGS"):
+			c.next()
+			var flags int
+			flags, err = c.expectInt()
+			t.flags |= uint32(flags)
+		default:
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (c *DCompiler) atTransition() bool {
+	tok := c.peek()
+	return tok.is("IF") || tok.is("+") || tok.is("COPY_TRANS")
+}
+
+func (c *DCompiler) parseTransition() (*dTransition, error) {
+	tok := c.next()
+	t := &dTransition{tok: tok}
+	switch {
+	case tok.is("COPY_TRANS"):
+		c.accept("SAFE")
+		name, err := c.expectName()
+		if err != nil {
+			return nil, err
+		}
+		label, err := c.expectWord()
+		if err != nil {
+			return nil, err
+		}
+		t.copyDlg = name
+		t.copyLabel = label.Text
+		return t, nil
+	case tok.is("IF"):
+		trigger, err := c.expectString()
+		if err != nil {
+			return nil, err
+		}
+		t.trigger = trigger
+		c.accept("THEN")
+	case tok.is("+"):
+		if !c.accept("+") {
+			trigger, err := c.expectString()
+			if err != nil {
+				return nil, err
+			}
+			t.trigger = trigger
+			if err = c.expect("+"); err != nil {
+				return nil, err
+			}
+		}
+		reply, err := c.parseText()
+		if err != nil {
+			return nil, err
+		}
+		t.hasReply = true
+		t.reply = reply
+	default:
+		return nil, tok.errorf("expected transition, found %s", tok)
+	}
+	if err := c.parseTransitionFeatures(t); err != nil {
+		return nil, err
+	}
+	if err := c.parseTransitionNext(t); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (c *DCompiler) parseTransitions() ([]*dTransition, error) {
+	trans := []*dTransition{}
+	for c.atTransition() {
+		t, err := c.parseTransition()
+		if err != nil {
+			return nil, err
+		}
+		trans = append(trans, t)
+	}
+	return trans, nil
+}
+
+func (c *DCompiler) parseWeight(state *dState) error {
+	if c.accept("WEIGHT") {
+		weight, err := c.expectInt()
+		if err != nil {
+			return err
+		}
+		state.hasWeight = true
+		state.weight = weight
+	}
+	return nil
+}
+
+// Parses IF ~trigger~ THEN BEGIN label SAY text transitions END, a SAY with
+// several = separated texts becomes a run of linked states
+func (c *DCompiler) parseState(dlg string) error {
+	state := &dState{dlg: dlg, tok: c.peek()}
+	if err := c.expect("IF"); err != nil {
+		return err
+	}
+	if err := c.parseWeight(state); err != nil {
+		return err
+	}
+	trigger, err := c.expectString()
+	if err != nil {
+		return err
+	}
+	state.trigger = trigger
+	c.accept("THEN")
+	c.accept("BEGIN")
+	label, err := c.expectWord()
+	if err != nil {
+		return err
+	}
+	state.label = label.Text
+	if err = c.expect("SAY"); err != nil {
+		return err
+	}
+	if state.say, err = c.parseText(); err != nil {
+		return err
+	}
+	c.items = append(c.items, state)
+	for c.accept("=") {
+		next := &dState{dlg: dlg, label: c.newLabel(), tok: c.peek()}
+		if next.say, err = c.parseText(); err != nil {
+			return err
+		}
+		state.trans = []*dTransition{{nextLabel: next.label, tok: next.tok}}
+		state = next
+		c.items = append(c.items, state)
+	}
+	if state.trans, err = c.parseTransitions(); err != nil {
+		return err
+	}
+	return c.expect("END")
+}
+
+// Parses [IF ~cond~ THEN] text [DO ~action~] {= [IF ~cond~ THEN] text [DO ~action~]}
+func (c *DCompiler) parseChainLines(dlg string, lines []*dChainLine) ([]*dChainLine, error) {
+	for {
+		line := &dChainLine{dlg: dlg, label: c.newLabel(), tok: c.peek()}
+		if c.accept("IF") {
+			cond, err := c.expectString()
+			if err != nil {
+				return nil, err
+			}
+			line.cond = cond
+			c.accept("THEN")
+		}
+		var err error
+		if line.say, err = c.parseText(); err != nil {
+			return nil, err
+		}
+		if c.accept("DO") {
+			if line.action, err = c.expectString(); err != nil {
+				return nil, err
+			}
+		}
+		lines = append(lines, line)
+		if !c.accept("=") {
+			return lines, nil
+		}
+	}
+}
+
+func (c *DCompiler) parseChainSpeakers(lines []*dChainLine) ([]*dChainLine, error) {
+	for c.accept("==") {
+		c.accept("IF_FILE_EXISTS")
+		name, err := c.expectName()
+		if err != nil {
+			return nil, err
+		}
+		if lines, err = c.parseChainLines(name, lines); err != nil {
+			return nil, err
+		}
+	}
+	return lines, nil
+}
+
+func (c *DCompiler) parseChainEpilogue() ([]*dTransition, error) {
+	tok := c.next()
+	switch {
+	case tok.is("EXIT"):
+		return []*dTransition{{flags: DLG_TRANS_EXIT, tok: tok}}, nil
+	case tok.is("COPY_TRANS"):
+		c.pos--
+		t, err := c.parseTransition()
+		return []*dTransition{t}, err
+	case tok.is("END") && c.atTransition():
+		return c.parseTransitions()
+	case tok.is("END"), tok.is("EXTERN"):
+		name, err := c.expectName()
+		if err != nil {
+			return nil, err
+		}
+		label, err := c.expectWord()
+		if err != nil {
+			return nil, err
+		}
+		return []*dTransition{{nextDlg: name, nextLabel: label.Text, tok: tok}}, nil
+	}
+	return nil, tok.errorf("expected END, EXTERN, COPY_TRANS or EXIT, found %s", tok)
+}
+
+// Builds the transitions leaving a chain line, lines guarded by a condition
+// are skipped when it is false.  Transitions are evaluated bottom up so the
+// nearest line comes last.
+func chainTransitions(lines []*dChainLine, from int, epilogue []*dTransition, trigger string, action string) []*dTransition {
+	trans := []*dTransition{}
+	last := from + 1
+	for last < len(lines) && lines[last].cond != "" {
+		last++
+	}
+	joinScript := func(a, b string) string {
+		return strings.TrimSpace(a + "\n" + b)
+	}
+	if last < len(lines) {
+		trans = append(trans, &dTransition{trigger: trigger, action: action, nextDlg: lines[last].dlg, nextLabel: lines[last].label, tok: lines[last].tok})
+	} else {
+		for _, t := range epilogue {
+			copied := *t
+			copied.trigger = joinScript(trigger, t.trigger)
+			copied.action = joinScript(action, t.action)
+			trans = append(trans, &copied)
+		}
+	}
+	for idx := last - 1; idx > from; idx-- {
+		trans = append(trans, &dTransition{trigger: joinScript(trigger, lines[idx].cond), action: action, nextDlg: lines[idx].dlg, nextLabel: lines[idx].label, tok: lines[idx].tok})
+	}
+	return trans
+}
+
+func (c *DCompiler) addChainStates(lines []*dChainLine, epilogue []*dTransition) []*dState {
+	states := []*dState{}
+	for idx, line := range lines {
+		state := &dState{dlg: line.dlg, label: line.label, say: line.say, tok: line.tok}
+		state.trans = chainTransitions(lines, idx, epilogue, "", line.action)
+		c.items = append(c.items, state)
+		states = append(states, state)
+	}
+	return states
+}
+
+// CHAIN [IF [WEIGHT #n] ~trigger~ THEN] file label lines epilogue
+func (c *DCompiler) parseChain() error {
+	first := &dState{tok: c.peek()}
+	if c.accept("IF") {
+		if err := c.parseWeight(first); err != nil {
+			return err
+		}
+		trigger, err := c.expectString()
+		if err != nil {
+			return err
+		}
+		first.trigger = trigger
+		if err = c.expect("THEN"); err != nil {
+			return err
+		}
+	}
+	name, err := c.expectName()
+	if err != nil {
+		return err
+	}
+	label, err := c.expectWord()
+	if err != nil {
+		return err
+	}
+	lines, err := c.parseChainLines(name, nil)
+	if err != nil {
+		return err
+	}
+	lines[0].label = label.Text
+	if lines, err = c.parseChainSpeakers(lines); err != nil {
+		return err
+	}
+	epilogue, err := c.parseChainEpilogue()
+	if err != nil {
+		return err
+	}
+	states := c.addChainStates(lines, epilogue)
+	states[0].trigger = strings.TrimSpace(first.trigger + "\n" + lines[0].cond)
+	states[0].hasWeight = first.hasWeight
+	states[0].weight = first.weight
+	return nil
+}
+
+// INTERJECT file label global lines epilogue, the lines are entered from the
+// state file label the first time it is reached with global still 0
+func (c *DCompiler) parseInterject(copyTrans bool) error {
+	tok := c.peek()
+	name, err := c.expectName()
+	if err != nil {
+		return err
+	}
+	label, err := c.expectWord()
+	if err != nil {
+		return err
+	}
+	global, err := c.expectWord()
+	if err != nil {
+		return err
+	}
+	lines := []*dChainLine{}
+	if !c.peek().is("==") {
+		if lines, err = c.parseChainLines(name, lines); err != nil {
+			return err
+		}
+	}
+	if lines, err = c.parseChainSpeakers(lines); err != nil {
+		return err
+	}
+	if len(lines) == 0 {
+		return c.peek().errorf("expected == before %s", c.peek())
+	}
+	var epilogue []*dTransition
+	if copyTrans {
+		if err = c.expect("END"); err != nil {
+			return err
+		}
+		epilogue = []*dTransition{{copyDlg: name, copyLabel: label.Text, tok: tok}}
+	} else if epilogue, err = c.parseChainEpilogue(); err != nil {
+		return err
+	}
+	c.addChainStates(lines, epilogue)
+
+	// The interjected state takes the place of the line before the first,
+	// when every line is conditional its own transitions are the fallback
+	entry := append([]*dChainLine{{cond: "1"}}, lines...)
+	trigger := fmt.Sprintf("Global(\"%s\",\"GLOBAL\",0)", global.Text)
+	action := fmt.Sprintf("SetGlobal(\"%s\",\"GLOBAL\",1)", global.Text)
+	trans := chainTransitions(entry, 0, nil, trigger, action)
+	c.items = append(c.items, &dExtend{dlg: name, labels: []string{label.Text}, position: -1, trans: trans, tok: tok})
+	return nil
+}
+
+// EXTEND_TOP/EXTEND_BOTTOM file label list [#position] transitions END
+func (c *DCompiler) parseExtend(top bool) error {
+	ext := &dExtend{tok: c.peek(), position: -1}
+	if top {
+		ext.position = 0
+	}
+	var err error
+	if ext.dlg, err = c.expectName(); err != nil {
+		return err
+	}
+	for !c.atTransition() && !c.peek().is("END") && !strings.HasPrefix(c.peek().Text, "#") {
+		label, err := c.expectWord()
+		if err != nil {
+			return err
+		}
+		ext.labels = append(ext.labels, label.Text)
+	}
+	if len(ext.labels) == 0 {
+		return c.peek().errorf("expected state label, found %s", c.peek())
+	}
+	if strings.HasPrefix(c.peek().Text, "#") {
+		if ext.position, err = c.expectInt(); err != nil {
+			return err
+		}
+	}
+	if ext.trans, err = c.parseTransitions(); err != nil {
+		return err
+	}
+	c.items = append(c.items, ext)
+	return c.expect("END")
+}
+
+func (c *DCompiler) parse() error {
+	for c.peek().Kind != D_TOK_EOF {
+		tok := c.next()
+		var err error
+		switch {
+		case tok.is("BEGIN"):
+			name, err := c.expectName()
+			if err != nil {
+				return err
+			}
+			begin := &dBegin{dlg: name}
+			if _, err := strconv.Atoi(c.peek().Text); err == nil && c.peek().Kind == D_TOK_WORD {
+				flags, err := c.expectInt()
+				if err != nil {
+					return err
+				}
+				begin.flags = uint32(flags)
+			}
+			c.items = append(c.items, begin)
+			for c.peek().is("IF") {
+				if err = c.parseState(name); err != nil {
+					return err
+				}
+			}
+		case tok.is("APPEND"), tok.is("APPEND_EARLY"):
+			c.accept("IF_FILE_EXISTS")
+			name, err := c.expectName()
+			if err != nil {
+				return err
+			}
+			for c.peek().is("IF") {
+				if err = c.parseState(name); err != nil {
+					return err
+				}
+			}
+			err = c.expect("END")
+		case tok.is("EXTEND_TOP"), tok.is("EXTEND_BOTTOM"):
+			err = c.parseExtend(tok.is("EXTEND_TOP"))
+		case tok.is("CHAIN"):
+			err = c.parseChain()
+		case tok.is("INTERJECT"), tok.is("INTERJECT_COPY_TRANS"):
+			err = c.parseInterject(tok.is("INTERJECT_COPY_TRANS"))
+		default:
+			err = tok.errorf("unexpected %s", tok)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *DCompiler) resolve(dlg string, label string, tok dToken) (int, error) {
+	if idx, ok := c.labels[dlg][label]; ok {
+		return idx, nil
+	}
+	idx, err := strconv.Atoi(label)
+	if err != nil {
+		return 0, tok.errorf("unknown state %s in %s", label, dlg)
+	}
+	if d := c.Dialogs[dlg]; d != nil {
+		count, ok := c.counts[dlg]
+		if !ok {
+			count = len(d.States)
+		}
+		if idx < 0 || idx >= count {
+			return 0, tok.errorf("state %d out of range in %s", idx, dlg)
+		}
+	}
+	return idx, nil
+}
+
+// Assigns every new state its index so labels can be referenced before the
+// state is defined
+func (c *DCompiler) allocate() error {
+	for _, item := range c.items {
+		switch it := item.(type) {
+		case *dBegin:
+			c.Dialogs[it.dlg] = &DLG{}
+			c.Dialogs[it.dlg].Header.Flags = it.flags
+			c.labels[it.dlg] = make(map[string]int)
+			c.counts[it.dlg] = 0
+		case *dState:
+			dlg := c.Dialogs[it.dlg]
+			if dlg == nil {
+				return it.tok.errorf("dialog %s not found", it.dlg)
+			}
+			if _, ok := c.counts[it.dlg]; !ok {
+				c.counts[it.dlg] = len(dlg.States)
+				c.labels[it.dlg] = make(map[string]int)
+			}
+			if _, ok := c.labels[it.dlg][it.label]; ok {
+				return it.tok.errorf("duplicate state %s in %s", it.label, it.dlg)
+			}
+			it.index = c.counts[it.dlg]
+			c.labels[it.dlg][it.label] = it.index
+			c.counts[it.dlg]++
+		}
+	}
+	return nil
+}
+
+func (c *DCompiler) buildTransitions(dlg *DLG, owner string, trans []*dTransition) ([]DlgTransition, error) {
+	out := []DlgTransition{}
+	for _, t := range trans {
+		if t.copyDlg != "" {
+			src := c.Dialogs[t.copyDlg]
+			if src == nil {
+				return nil, t.tok.errorf("dialog %s not found", t.copyDlg)
+			}
+			idx, err := c.resolve(t.copyDlg, t.copyLabel, t.tok)
+			if err != nil {
+				return nil, err
+			}
+			if idx >= len(src.States) {
+				return nil, t.tok.errorf("state %s in %s is not defined yet", t.copyLabel, t.copyDlg)
+			}
+			for _, copied := range src.stateTransitions(src.States[idx]) {
+				out = append(out, dlg.CopyTransition(src, copied))
+			}
+			continue
+		}
+
+		dt := DlgTransition{Flags: t.flags}
+		if t.hasReply {
+			dt.Flags |= DLG_TRANS_TEXT
+			dt.TransitionText = t.reply
+		}
+		if t.hasJournal {
+			dt.Flags |= DLG_TRANS_JOURNAL
+			dt.JournalText = t.journal
+		}
+		if t.trigger != "" {
+			dt.Flags |= DLG_TRANS_TRIGGER
+			dt.TransitionTriggerIndex = dlg.AddTransitionTrigger(t.trigger)
+		}
+		if t.action != "" {
+			dt.Flags |= DLG_TRANS_ACTION
+			dt.TransitionActionIndex = dlg.AddAction(t.action)
+		}
+		if dt.Flags&DLG_TRANS_EXIT == 0 {
+			next := t.nextDlg
+			if next == "" {
+				next = owner
+			}
+			idx, err := c.resolve(next, t.nextLabel, t.tok)
+			if err != nil {
+				return nil, err
+			}
+			dt.NextDlg = NewResref(next)
+			dt.NextState = uint32(idx)
+		}
+		out = append(out, dt)
+	}
+	return out, nil
+}
+
+// Orders the state triggers of dlg by weight, existing triggers weigh their
+// position and new states without WEIGHT go last in the order they appear.
+func (c *DCompiler) weighStates(dlg *DLG, states []*dState) {
+	type weighted struct {
+		state   int
+		trigger string
+		weight  int
+		isNew   bool
+		seq     int
+	}
+	order := []weighted{}
+	explicit := false
+	for idx, state := range dlg.States {
+		if state.TriggerIndex >= 0 && int(state.TriggerIndex) < len(dlg.StateTriggers) {
+			order = append(order, weighted{idx, dlg.StateTriggers[state.TriggerIndex], int(state.TriggerIndex), false, idx})
+		}
+	}
+	for seq, state := range states {
+		weight := math.MaxInt32
+		if state.hasWeight {
+			weight = state.weight
+			explicit = true
+		}
+		order = append(order, weighted{state.index, state.trigger, weight, true, seq})
+	}
+	if !explicit {
+		for _, state := range states {
+			dlg.States[state.index].TriggerIndex = dlg.AddStateTrigger(state.trigger)
+		}
+		return
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		if order[i].weight != order[j].weight {
+			return order[i].weight < order[j].weight
+		}
+		if order[i].isNew != order[j].isNew {
+			return !order[i].isNew
+		}
+		return order[i].seq < order[j].seq
+	})
+	dlg.StateTriggers = []string{}
+	for _, w := range order {
+		dlg.States[w.state].TriggerIndex = dlg.AddStateTrigger(w.trigger)
+	}
+}
+
+func (c *DCompiler) emit() error {
+	triggered := make(map[string][]*dState)
+	names := []string{}
+	for _, item := range c.items {
+		switch it := item.(type) {
+		case *dState:
+			dlg := c.Dialogs[it.dlg]
+			trans, err := c.buildTransitions(dlg, it.dlg, it.trans)
+			if err != nil {
+				return err
+			}
+			if idx := dlg.AppendState(DlgState{Stringref: it.say, TriggerIndex: -1}, trans); idx != it.index {
+				return it.tok.errorf("state %s in %s added at %d instead of %d", it.label, it.dlg, idx, it.index)
+			}
+			if it.trigger != "" {
+				if _, ok := triggered[it.dlg]; !ok {
+					names = append(names, it.dlg)
+				}
+				triggered[it.dlg] = append(triggered[it.dlg], it)
+			}
+		case *dExtend:
+			dlg := c.Dialogs[it.dlg]
+			if dlg == nil {
+				return it.tok.errorf("dialog %s not found", it.dlg)
+			}
+			for _, label := range it.labels {
+				idx, err := c.resolve(it.dlg, label, it.tok)
+				if err != nil {
+					return err
+				}
+				if idx >= len(dlg.States) {
+					return it.tok.errorf("state %s in %s is not defined yet", label, it.dlg)
+				}
+				trans, err := c.buildTransitions(dlg, it.dlg, it.trans)
+				if err != nil {
+					return err
+				}
+				if err = dlg.InsertTransitions(idx, it.position, trans); err != nil {
+					return it.tok.errorf("%s", err)
+				}
+			}
+		}
+	}
+	for _, name := range names {
+		c.weighStates(c.Dialogs[name], triggered[name])
+	}
+	return nil
+}
+
+// Compiles D source.  Dialogs created with BEGIN or changed by APPEND,
+// EXTEND, CHAIN and INTERJECT are left in Dialogs ready for DLG.Write.  When
+// compiling fails neither the dialogs nor the talk table are changed.
+func (c *DCompiler) Compile(r io.Reader) error {
+	dialogs := c.Dialogs
+	c.Dialogs = make(map[string]*DLG, len(dialogs))
+	for name, dlg := range dialogs {
+		c.Dialogs[name] = dlg.clone()
+	}
+	err := c.compile(r)
+	if err != nil {
+		c.Dialogs = dialogs
+		c.dropStrings()
+		return err
+	}
+	for name, dlg := range c.Dialogs {
+		if orig := dialogs[name]; orig != nil {
+			*orig = *dlg
+			c.Dialogs[name] = orig
+		}
+	}
+	c.addStrings()
+	return nil
+}
+
+func (c *DCompiler) compile(r io.Reader) error {
+	src, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	c.tokens, err = dTokenize(string(src))
+	if err != nil {
+		return err
+	}
+	c.pos = 0
+	c.items = nil
+	c.labels = make(map[string]map[string]int)
+	c.counts = make(map[string]int)
+	if err = c.parse(); err != nil {
+		return err
+	}
+	if err = c.allocate(); err != nil {
+		return err
+	}
+	return c.emit()
+}
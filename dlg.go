@@ -1,11 +1,12 @@
 package bg
 
 import (
+	"bytes"
 	"encoding/binary"
 	"encoding/json"
+	"fmt"
 	"io"
 	"os"
-	"strconv"
 )
 
 type dlgHeader struct {
@@ -23,6 +24,9 @@ type dlgHeader struct {
 	Flags                   uint32
 }
 
+// Size of the original V1.0 header which lacks the Flags field
+const DLG_V10_HEADER_SIZE = 0x30
+
 type DlgState struct {
 	Stringref       uint32
 	TransitionIndex uint32
@@ -79,6 +83,59 @@ func (trans *DlgTransition) AddCompleteQuest() bool {
 	return trans.Flags&0x0100 == 0x0100
 }
 
+func (dlg *DLG) AddStateTrigger(trigger string) int32 {
+	dlg.StateTriggers = append(dlg.StateTriggers, trigger)
+	return int32(len(dlg.StateTriggers) - 1)
+}
+
+func (dlg *DLG) AddTransitionTrigger(trigger string) uint32 {
+	dlg.TransitionTriggers = append(dlg.TransitionTriggers, trigger)
+	return uint32(len(dlg.TransitionTriggers) - 1)
+}
+
+func (dlg *DLG) AddAction(action string) uint32 {
+	dlg.Actions = append(dlg.Actions, action)
+	return uint32(len(dlg.Actions) - 1)
+}
+
+// Appends state with its transitions placed at the end of the transition
+// table and returns the new state index, as WeiDU APPEND does
+func (dlg *DLG) AppendState(state DlgState, transitions []DlgTransition) int {
+	state.TransitionIndex = uint32(len(dlg.Transitions))
+	state.TransitionCount = uint32(len(transitions))
+	dlg.Transitions = append(dlg.Transitions, transitions...)
+	dlg.States = append(dlg.States, state)
+	return len(dlg.States) - 1
+}
+
+// Inserts transitions into stateIdx before its transition at pos, a pos out
+// of range appends them.  The transition indexes of the states that follow
+// are shifted to match.
+func (dlg *DLG) InsertTransitions(stateIdx int, pos int, transitions []DlgTransition) error {
+	if stateIdx < 0 || stateIdx >= len(dlg.States) {
+		return fmt.Errorf("State out of range: %d >= %d", stateIdx, len(dlg.States))
+	}
+	state := &dlg.States[stateIdx]
+	if pos < 0 || pos > int(state.TransitionCount) {
+		pos = int(state.TransitionCount)
+	}
+	at := int(state.TransitionIndex) + pos
+	if at > len(dlg.Transitions) {
+		return fmt.Errorf("State %d transitions out of range: %d > %d", stateIdx, at, len(dlg.Transitions))
+	}
+	n := len(transitions)
+	dlg.Transitions = append(dlg.Transitions, transitions...)
+	copy(dlg.Transitions[at+n:], dlg.Transitions[at:len(dlg.Transitions)-n])
+	copy(dlg.Transitions[at:], transitions)
+	for idx := range dlg.States {
+		if idx != stateIdx && int(dlg.States[idx].TransitionIndex) >= at {
+			dlg.States[idx].TransitionIndex += uint32(n)
+		}
+	}
+	state.TransitionCount += uint32(n)
+	return nil
+}
+
 /*
 func (dlg *DLG) Print(tlk *TLK) {
 	for idx, state := range dlg.States {
@@ -110,22 +167,6 @@ func (dlg *DLG) Print(tlk *TLK) {
 		}
 	}
 }
-
-func (dlg *DLG) PrintDot(tlk *TLK, root string) {
-	root = strings.ToLower(root)
-	for idx, state := range dlg.States {
-		//str, _ := tlk.String(int(state.Stringref))
-		if state.TriggerIndex >= 0 {
-			fmt.Printf("%s -> %s_s%d;\n", root, root, idx);
-		}
-		for _, transition := range dlg.Transitions[state.TransitionIndex : state.TransitionIndex + state.TransitionCount] {
-			if !transition.TerminatesDialog() {
-				//fmt.Printf("%s_s%d -> %s_s%d_t%d;\n", root, idx, root, idx, tIdx)
-				fmt.Printf("%s_s%d -> %s_s%d;\n", root, idx, strings.ToLower(transition.NextDlg.String()), transition.NextState)
-			}
-		}
-	}
-}
 */
 
 func OpenDlg(r io.ReadSeeker) (*DLG, error) {
@@ -135,6 +176,10 @@ func OpenDlg(r io.ReadSeeker) (*DLG, error) {
 	if err != nil {
 		return nil, err
 	}
+	// Old dialogs have no Flags, the states start where they would be
+	if dlg.Header.StateOffset < uint32(binary.Size(dlg.Header)) {
+		dlg.Header.Flags = 0
+	}
 
 	dlg.States = make([]DlgState, dlg.Header.StateCount)
 	_, err = r.Seek(int64(dlg.Header.StateOffset), os.SEEK_SET)
@@ -210,6 +255,83 @@ func OpenDlg(r io.ReadSeeker) (*DLG, error) {
 	return dlg, nil
 }
 
+func dlgStringTable(strs []string, offset uint32) ([]dlgOffsetLength, uint32) {
+	table := make([]dlgOffsetLength, len(strs))
+	for idx, str := range strs {
+		table[idx] = dlgOffsetLength{Offset: offset, Length: uint32(len(str))}
+		offset += uint32(len(str))
+	}
+	return table, offset
+}
+
+func (dlg *DLG) clone() *DLG {
+	return &DLG{
+		Header:             dlg.Header,
+		States:             append([]DlgState(nil), dlg.States...),
+		Transitions:        append([]DlgTransition(nil), dlg.Transitions...),
+		StateTriggers:      append([]string(nil), dlg.StateTriggers...),
+		TransitionTriggers: append([]string(nil), dlg.TransitionTriggers...),
+		Actions:            append([]string(nil), dlg.Actions...),
+	}
+}
+
+// Writes the dialog recomputing every count and offset in the header.  Dialogs
+// read with the old header without Flags are written the same way.
+func (dlg *DLG) Write(w io.Writer) error {
+	ol := dlgOffsetLength{}
+	header := dlg.Header
+	h := &header
+	if h.Signature == [4]byte{} {
+		h.Signature = [4]byte{'D', 'L', 'G', ' '}
+		h.Version = [4]byte{'V', '1', '.', '0'}
+	}
+	headerSize := uint32(binary.Size(header))
+	if h.StateOffset == DLG_V10_HEADER_SIZE && h.Flags == 0 {
+		headerSize = DLG_V10_HEADER_SIZE
+	}
+
+	h.StateCount = uint32(len(dlg.States))
+	h.StateOffset = headerSize
+	h.TransitionCount = uint32(len(dlg.Transitions))
+	h.TransitionOffset = h.StateOffset + uint32(binary.Size(dlg.States))
+	h.StateTriggerCount = uint32(len(dlg.StateTriggers))
+	h.StateTriggerOffset = h.TransitionOffset + uint32(binary.Size(dlg.Transitions))
+	h.TransitionTriggerCount = uint32(len(dlg.TransitionTriggers))
+	h.TransitionTriggerOffset = h.StateTriggerOffset + h.StateTriggerCount*uint32(binary.Size(ol))
+	h.ActionCount = uint32(len(dlg.Actions))
+	h.ActionOffset = h.TransitionTriggerOffset + h.TransitionTriggerCount*uint32(binary.Size(ol))
+
+	offset := h.ActionOffset + h.ActionCount*uint32(binary.Size(ol))
+	stateTriggers, offset := dlgStringTable(dlg.StateTriggers, offset)
+	transitionTriggers, offset := dlgStringTable(dlg.TransitionTriggers, offset)
+	actions, _ := dlgStringTable(dlg.Actions, offset)
+
+	var buf bytes.Buffer
+	err := binary.Write(&buf, binary.LittleEndian, header)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(buf.Bytes()[0:headerSize])
+	if err != nil {
+		return err
+	}
+	for _, data := range []interface{}{dlg.States, dlg.Transitions, stateTriggers, transitionTriggers, actions} {
+		err = binary.Write(w, binary.LittleEndian, data)
+		if err != nil {
+			return err
+		}
+	}
+	for _, strs := range [][]string{dlg.StateTriggers, dlg.TransitionTriggers, dlg.Actions} {
+		for _, str := range strs {
+			_, err = io.WriteString(w, str)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 func (dialog *DLG) WriteJson(w io.Writer) error {
 	bytes, err := json.MarshalIndent(dialog, "", "\t")
 	if err != nil {
@@ -245,15 +367,8 @@ func fetch(tlk *TLK, id uint32) string {
 	return str
 }
 
-func (d *DLG) ToJson(tlk *TLK) ([]byte, error) {
-	var graph dlgGraph
-	for i, state := range d.States {
-		graph.Nodes = append(graph.Nodes, dlgNode{Label: fetch(tlk, state.Stringref), Id: strconv.Itoa(i)})
-	}
-	for i, t := range d.Transitions {
-		graph.Edges = append(graph.Edges, dlgEdge{Source: "_" + strconv.Itoa(i), Target: t.NextDlg.String() + "_" + strconv.Itoa(int(t.NextState)), Id: strconv.Itoa(i)})
-
-	}
-
+// Returns the sigma.js graph of the dialog, name is its resource name
+func (d *DLG) ToJson(name string, tlk *TLK) ([]byte, error) {
+	graph := d.Graph(name, tlk).sigma()
 	return json.MarshalIndent(graph, "", "\t")
 }
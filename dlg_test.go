@@ -0,0 +1,436 @@
+package bg
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func newTestDlg() *DLG {
+	dlg := &DLG{
+		States: []DlgState{
+			{Stringref: 10, TransitionIndex: 0, TransitionCount: 2, TriggerIndex: 0},
+			{Stringref: 11, TransitionIndex: 2, TransitionCount: 1, TriggerIndex: -1},
+		},
+		Transitions: []DlgTransition{
+			{Flags: 0x0001, TransitionText: 20, NextState: 1},
+			{Flags: 0x0001 | 0x0002 | 0x0004 | 0x0008, TransitionText: 21, TransitionTriggerIndex: 0, TransitionActionIndex: 0},
+			{Flags: 0x0008},
+		},
+		StateTriggers:      []string{"NumTimesTalkedTo(0)\r\n"},
+		TransitionTriggers: []string{"Global(\"X\",\"GLOBAL\",1)"},
+		Actions:            []string{"SetGlobal(\"X\",\"GLOBAL\",2)"},
+	}
+	dlg.Header.Flags = 3
+	return dlg
+}
+
+func TestDlgWrite(t *testing.T) {
+	dlg := newTestDlg()
+	var buf bytes.Buffer
+	if err := dlg.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	out, err := OpenDlg(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dlg.Header != newTestDlg().Header {
+		t.Errorf("Write changed the dialog header: %+v", dlg.Header)
+	}
+	if h := out.Header; string(h.Signature[:]) != "DLG " || h.Flags != 3 || h.StateCount != 2 || h.ActionCount != 1 {
+		t.Errorf("Bad written header: %+v", h)
+	}
+	header := out.Header
+	out.Header = dlg.Header
+	if !reflect.DeepEqual(dlg, out) {
+		t.Errorf("Dialog did not round trip\n%+v\n%+v", dlg, out)
+	}
+	out.Header = header
+
+	out.Header.Flags = 0
+	out.Header.StateOffset = DLG_V10_HEADER_SIZE
+	buf.Reset()
+	if err = out.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	old, err := OpenDlg(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if old.Header.StateOffset != DLG_V10_HEADER_SIZE || !reflect.DeepEqual(old.States, dlg.States) {
+		t.Errorf("Old dialog did not round trip\n%+v", old)
+	}
+}
+
+func TestDlgWriteD(t *testing.T) {
+	dlg := newTestDlg()
+	dlg.Transitions[0].Flags |= DLG_TRANS_JOURNAL | DLG_TRANS_SOLVED
+	dlg.Transitions[0].JournalText = 30
+	dlg.Transitions[2].Flags = 0
+	dlg.Transitions[2].NextDlg = NewResref("OTHER")
+	var buf bytes.Buffer
+	if err := dlg.WriteD(&buf, "test", DlgDOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	expected := `// creator  : bgfileformats
+// argument : TEST.DLG
+
+BEGIN ~TEST~ 3
+
+IF ~NumTimesTalkedTo(0)~ THEN BEGIN 0
+  SAY #10
+  IF ~~ THEN REPLY #20 SOLVED_JOURNAL #30 GOTO 1
+  IF ~Global("X","GLOBAL",1)~ THEN REPLY #21 DO ~SetGlobal("X","GLOBAL",2)~ EXIT
+END
+
+IF ~~ THEN BEGIN 1 // from: 0.0
+  SAY #11
+  IF ~~ THEN EXTERN ~OTHER~ 0
+END
+`
+	if buf.String() != expected {
+		t.Errorf("WriteD:\n%s\nexpected:\n%s", buf.String(), expected)
+	}
+}
+
+func TestDCompileRoundTrip(t *testing.T) {
+	var src, out bytes.Buffer
+	dlg := newTestDlg()
+	dlg.States[0].TriggerIndex = 2
+	dlg.States[1].TriggerIndex = 1
+	dlg.StateTriggers = []string{"A()", "B()", "C()"}
+	dlg.States = append(dlg.States, DlgState{Stringref: 12, TransitionIndex: 3, TriggerIndex: 0})
+	dlg.Transitions[2].Flags = DLG_TRANS_EXIT | DLG_TRANS_INTERRUPT
+	if err := dlg.WriteD(&src, "test", DlgDOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewDCompiler(nil)
+	if err := c.Compile(bytes.NewReader(src.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Dialog("test").WriteD(&out, "test", DlgDOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if src.String() != out.String() {
+		t.Errorf("D did not round trip:\n%s\n%s", src.String(), out.String())
+	}
+}
+
+func TestDCompile(t *testing.T) {
+	tlk, female := newTestTlk("zero"), newTestTlk("zero")
+	c := NewDCompiler(NewTalkTable(tlk, female))
+	c.AddDialog("old", newTestDlg())
+	err := c.LoadTra(bytes.NewReader([]byte("@1 = ~Hello~ [HELLO]\n@2 = ~Bye~")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Compile(bytes.NewReader([]byte(`
+BEGIN new
+IF ~True()~ THEN BEGIN greet
+  SAY @1 = ~More~
+  ++ @2 EXIT
+  + ~False()~ + ~Other~ GOTO greet
+END
+
+APPEND old
+IF ~~ THEN BEGIN added
+  SAY #5
+  IF ~~ THEN EXTERN new greet
+END
+END
+
+EXTEND_TOP old 0
+  IF ~~ THEN GOTO added
+END
+
+CHAIN IF ~Cond()~ THEN new chained
+  ~One~
+  == old IF ~InParty("X")~ THEN ~Two~
+  == new ~Three~ ~Trois~
+EXIT
+
+INTERJECT old 1 Interjected
+  == new IF ~InParty("Y")~ THEN ~Four~
+END old 1
+`)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if str, _ := tlk.String(1); str != "Hello" || tlk.GetStringCount() != 9 {
+		t.Errorf("Unexpected strings: %q count %d", str, tlk.GetStringCount())
+	}
+	if entry, _ := tlk.Entry(1); entry.Sound.String() != "HELLO" {
+		t.Errorf("Unexpected sound %q", entry.Sound.String())
+	}
+	if str, _ := female.String(7); str != "Trois" || female.GetStringCount() != 9 {
+		t.Errorf("Unexpected female strings: %q count %d", str, female.GetStringCount())
+	}
+	if str, _ := female.String(1); str != "" {
+		t.Errorf("Female string without variant should be empty: %q", str)
+	}
+
+	dlg := c.Dialog("new")
+	if len(dlg.States) != 5 || len(dlg.StateTriggers) != 2 {
+		t.Fatalf("Unexpected dialog: %+v", dlg)
+	}
+	if tr := dlg.stateTransitions(dlg.States[1]); len(tr) != 2 || !tr[0].TerminatesDialog() || tr[1].NextState != 0 {
+		t.Errorf("Unexpected transitions: %+v", tr)
+	}
+	// The conditional line is skipped unless its trigger is true
+	if tr := dlg.stateTransitions(dlg.States[2]); len(tr) != 2 || tr[0].NextState != 3 || tr[1].NextDlg.String() != "OLD" || tr[1].NextState != 3 {
+		t.Errorf("Unexpected chain transitions: %+v", tr)
+	}
+
+	old := c.Dialog("old")
+	if len(old.States) != 4 || old.States[0].TransitionCount != 3 || old.States[1].TransitionIndex != 3 {
+		t.Fatalf("Unexpected dialog: %+v", old.States)
+	}
+	if tr := old.Transitions[0]; tr.NextState != 2 || tr.NextDlg.String() != "OLD" {
+		t.Errorf("Unexpected extended transition: %+v", tr)
+	}
+	tr := old.stateTransitions(old.States[1])
+	if len(tr) != 2 || tr[1].NextDlg.String() != "NEW" || tr[1].NextState != 4 ||
+		old.TransitionTriggers[tr[1].TransitionTriggerIndex] != "Global(\"Interjected\",\"GLOBAL\",0)\nInParty(\"Y\")" {
+		t.Errorf("Unexpected interjection: %+v", tr)
+	}
+
+	err = c.Compile(bytes.NewReader([]byte("BEGIN bad\nIF ~~ THEN BEGIN 0\n  SAY ~x~\n  IF ~~ THEN GOTO missing\nEND\n")))
+	if derr, ok := err.(DError); !ok || derr.Line != 4 || derr.Column != 3 {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if tlk.GetStringCount() != 9 || c.Dialog("bad") != nil {
+		t.Errorf("Failed compile left strings or dialogs behind")
+	}
+	err = c.Compile(bytes.NewReader([]byte("APPEND old\nIF ~~ THEN BEGIN more\n  SAY ~y~\n  IF ~~ THEN GOTO missing\nEND\nEND\n")))
+	if err == nil || len(c.Dialog("old").States) != 4 || c.Dialog("old") != old {
+		t.Errorf("Failed compile changed an existing dialog: %v", err)
+	}
+}
+
+func TestDlgGraph(t *testing.T) {
+	dlg := newTestDlg()
+	dlg.Transitions[2].Flags = 0
+	dlg.Transitions[2].NextDlg = NewResref("other")
+
+	g := dlg.Graph("test", nil)
+	kinds := map[int]int{}
+	for _, node := range g.Nodes {
+		kinds[node.Kind]++
+	}
+	if kinds[DLG_NODE_ROOT] != 1 || kinds[DLG_NODE_STATE] != 2 || kinds[DLG_NODE_REPLY] != 3 ||
+		kinds[DLG_NODE_EXIT] != 1 || kinds[DLG_NODE_EXTERN] != 1 {
+		t.Errorf("Unexpected nodes: %+v", g.Nodes)
+	}
+	for _, edge := range g.Edges {
+		if g.Node(edge.Source) == nil || g.Node(edge.Target) == nil {
+			t.Errorf("Dangling edge: %+v", edge)
+		}
+	}
+	if node := g.Node("TEST_s0_t1"); node == nil || node.Trigger != "Global(\"X\",\"GLOBAL\",1)" || node.Strref != 21 {
+		t.Errorf("Unexpected reply node: %+v", node)
+	}
+	if node := g.Node("OTHER_s0"); node == nil || node.Kind != DLG_NODE_EXTERN {
+		t.Errorf("Unexpected extern node: %+v", node)
+	}
+}
+
+func TestDlgGraphWriters(t *testing.T) {
+	dlg := &DLG{
+		States:        []DlgState{{Stringref: 10, TransitionCount: 1}},
+		Transitions:   []DlgTransition{{Flags: DLG_TRANS_TEXT | DLG_TRANS_ACTION | DLG_TRANS_EXIT, TransitionText: 20}},
+		StateTriggers: []string{"True()"},
+		Actions:       []string{"SetGlobal(\"X\",\"GLOBAL\",1)"},
+	}
+	g := dlg.Graph("test", nil)
+
+	var buf bytes.Buffer
+	if err := g.WriteDot(&buf); err != nil {
+		t.Fatal(err)
+	}
+	expected := `digraph dialog {
+	"TEST" [shape=doublecircle label="TEST"];
+	"TEST_s0" [shape=box label="#10"];
+	"TEST_s0_t0" [shape=ellipse label="#20\nDO SetGlobal(\"X\",\"GLOBAL\",1)"];
+	"TEST_exit" [shape=octagon label="EXIT"];
+	"TEST" -> "TEST_s0" [label="True()"];
+	"TEST_s0" -> "TEST_s0_t0";
+	"TEST_s0_t0" -> "TEST_exit";
+}
+`
+	if buf.String() != expected {
+		t.Errorf("WriteDot:\n%s\nexpected:\n%s", buf.String(), expected)
+	}
+
+	buf.Reset()
+	if err := g.WriteGraphML(&buf); err != nil {
+		t.Fatal(err)
+	}
+	var graphml struct {
+		Nodes []struct {
+			Id   string `xml:"id,attr"`
+			Data []struct {
+				Key   string `xml:"key,attr"`
+				Value string `xml:",chardata"`
+			} `xml:"data"`
+		} `xml:"graph>node"`
+		Edges []struct {
+			Source string `xml:"source,attr"`
+			Target string `xml:"target,attr"`
+		} `xml:"graph>edge"`
+	}
+	if err := xml.Unmarshal(buf.Bytes(), &graphml); err != nil {
+		t.Fatal(err)
+	}
+	if len(graphml.Nodes) != 4 || len(graphml.Edges) != 3 || graphml.Edges[2].Target != "TEST_exit" {
+		t.Fatalf("Unexpected GraphML: %+v", graphml)
+	}
+	action := ""
+	for _, data := range graphml.Nodes[2].Data {
+		if data.Key == "action" {
+			action = data.Value
+		}
+	}
+	if action != dlg.Actions[0] {
+		t.Errorf("GraphML action %q", action)
+	}
+
+	buf.Reset()
+	if err := g.WriteSigmaJson(&buf); err != nil {
+		t.Fatal(err)
+	}
+	var sigma dlgGraph
+	if err := json.Unmarshal(buf.Bytes(), &sigma); err != nil {
+		t.Fatal(err)
+	}
+	if len(sigma.Nodes) != 4 || len(sigma.Edges) != 3 {
+		t.Fatalf("Unexpected sigma graph: %+v", sigma)
+	}
+	if node := sigma.Nodes[3]; node.Id != "TEST_exit" || node.X != 3 || node.Color != dlgNodeColors[DLG_NODE_EXIT] {
+		t.Errorf("Unexpected sigma node: %+v", node)
+	}
+
+	// A dialog mostly leading elsewhere keeps its own name
+	dlg = newTestDlg()
+	dlg.Transitions[0].NextDlg = NewResref("other")
+	dlg.Transitions[2].Flags = 0
+	dlg.Transitions[2].NextDlg = NewResref("other")
+	data, err := dlg.ToJson("test", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf.Reset()
+	dlg.Graph("test", nil).WriteSigmaJson(&buf)
+	if !bytes.Equal(data, buf.Bytes()) {
+		t.Errorf("ToJson does not match the named graph:\n%s", data)
+	}
+}
+
+func TestBuildDialogGraph(t *testing.T) {
+	c := NewDCompiler(nil)
+	err := c.Compile(bytes.NewReader([]byte(`
+BEGIN root
+IF ~True()~ THEN BEGIN 0
+  SAY #1
+  IF ~~ THEN EXTERN other 0
+  IF ~~ THEN EXTERN trap 0
+  IF ~~ THEN EXIT
+END
+IF ~~ THEN BEGIN 1
+  SAY #2
+  IF ~~ THEN EXIT
+END
+
+BEGIN trap
+IF ~~ THEN BEGIN 0
+  SAY #5
+  IF ~~ THEN GOTO 0
+  IF ~False()~ THEN EXIT
+END
+
+BEGIN other
+IF ~~ THEN BEGIN 0
+  SAY #3
+  IF ~~ THEN GOTO 1
+END
+IF ~~ THEN BEGIN 1
+  SAY #4
+  IF ~~ THEN GOTO 0
+END
+`)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := c.Dialog("root")
+	root.Transitions = append(root.Transitions,
+		DlgTransition{NextDlg: NewResref("MISSING")},
+		DlgTransition{NextDlg: NewResref("OTHER"), NextState: 5})
+	root.States[1].TransitionCount = 3
+
+	g, problems, err := BuildDialogGraph("root", func(name string) (*DLG, error) {
+		if dlg := c.Dialog(name); dlg != nil {
+			return dlg, nil
+		}
+		return nil, fmt.Errorf("%s not found", name)
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if node := g.Node("OTHER_s1"); node == nil || node.Kind != DLG_NODE_STATE {
+		t.Errorf("Other dialog not stitched: %+v", node)
+	}
+	kinds := map[int][]string{}
+	for _, p := range problems {
+		kinds[p.Kind] = append(kinds[p.Kind], p.String())
+	}
+	if len(kinds[DLG_PROBLEM_UNREACHABLE]) != 1 || len(kinds[DLG_PROBLEM_MISSING_DIALOG]) != 1 ||
+		len(kinds[DLG_PROBLEM_STATE_RANGE]) != 1 || len(kinds[DLG_PROBLEM_NO_EXIT]) != 2 {
+		t.Errorf("Unexpected problems: %v", kinds)
+	}
+}
+
+func TestDlgPatch(t *testing.T) {
+	dlg := newTestDlg()
+	if err := dlg.ExtendTop(0, []DlgTransition{dlg.NewTransition("True()", "")}); err != nil {
+		t.Fatal(err)
+	}
+	if dlg.States[0].TransitionCount != 3 || dlg.States[1].TransitionIndex != 3 {
+		t.Errorf("Bad states after extend: %+v", dlg.States)
+	}
+	if dlg.transitionTrigger(dlg.Transitions[0]) != "True()" {
+		t.Errorf("Bad inserted transition: %+v", dlg.Transitions[0])
+	}
+	if err := dlg.RemoveTransition(0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(dlg.States, newTestDlg().States) {
+		t.Errorf("Bad states after remove: %+v", dlg.States)
+	}
+	if err := dlg.ExtendBottom(5, nil); err == nil {
+		t.Errorf("Expected error for missing state")
+	}
+
+	offset := dlg.AppendDialog(newTestDlg(), "TEST", "OTHER")
+	if offset != 2 || len(dlg.States) != 4 || len(dlg.Transitions) != 6 {
+		t.Fatalf("Bad append: %d %+v", offset, dlg.States)
+	}
+	if trans := dlg.Transitions[3]; trans.NextState != 3 || trans.NextDlg.String() != "TEST" {
+		t.Errorf("Local transition not retargeted: %+v", trans)
+	}
+	if dlg.stateTrigger(dlg.States[2]) != "NumTimesTalkedTo(0)" || dlg.States[2].TriggerIndex != 1 {
+		t.Errorf("Bad appended trigger: %+v", dlg.States[2])
+	}
+	if err := dlg.InsertStateTrigger(3, 0, "True()"); err != nil {
+		t.Fatal(err)
+	}
+	if dlg.stateTrigger(dlg.States[3]) != "True()" || dlg.States[0].TriggerIndex != 1 || dlg.States[2].TriggerIndex != 2 {
+		t.Errorf("Bad trigger insert: %+v", dlg.States)
+	}
+	if err := dlg.InsertStateTrigger(4, 0, "True()"); err == nil || len(dlg.StateTriggers) != 3 {
+		t.Errorf("Expected error for state out of range")
+	}
+}
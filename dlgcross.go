@@ -0,0 +1,238 @@
+package bg
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	DLG_PROBLEM_UNREACHABLE = iota
+	DLG_PROBLEM_MISSING_DIALOG
+	DLG_PROBLEM_STATE_RANGE
+	DLG_PROBLEM_NO_EXIT
+)
+
+// A DialogProblem is found while checking a cross-file dialog graph.  Node is
+// the unreachable state or the transition with the bad target, Nodes holds
+// every node of a cycle without an exit.
+type DialogProblem struct {
+	Kind   int
+	Node   string
+	Target string
+	Nodes  []string
+	Err    error
+}
+
+func (p DialogProblem) String() string {
+	switch p.Kind {
+	case DLG_PROBLEM_UNREACHABLE:
+		return fmt.Sprintf("%s is unreachable", p.Node)
+	case DLG_PROBLEM_MISSING_DIALOG:
+		return fmt.Sprintf("%s leads to missing dialog %s: %v", p.Node, p.Target, p.Err)
+	case DLG_PROBLEM_STATE_RANGE:
+		return fmt.Sprintf("%s leads to %s which is out of range", p.Node, p.Target)
+	case DLG_PROBLEM_NO_EXIT:
+		return fmt.Sprintf("cycle without exit: %s", strings.Join(p.Nodes, " "))
+	}
+	return "unknown problem"
+}
+
+// Loads root and every dialog reachable from it through open and stitches
+// them into a single graph.  Problems with the dialogs are returned alongside
+// the graph, an error is only returned when root itself cannot be opened.
+func BuildDialogGraph(root string, open func(name string) (*DLG, error), tlk *TLK) (*DialogGraph, []DialogProblem, error) {
+	root = strings.ToUpper(root)
+	rootDlg, err := open(root)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	g := NewDialogGraph()
+	problems := []DialogProblem{}
+	dialogs := map[string]*DLG{root: rootDlg}
+	missing := map[string]error{}
+	queue := []string{root}
+	for len(queue) > 0 {
+		name := queue[0]
+		queue = queue[1:]
+		dlg := dialogs[name]
+		g.AddDialog(name, dlg, tlk)
+		for _, t := range dlg.Transitions {
+			next := strings.ToUpper(t.NextDlg.String())
+			if t.TerminatesDialog() || next == "" {
+				continue
+			}
+			if _, ok := dialogs[next]; ok {
+				continue
+			}
+			if _, ok := missing[next]; ok {
+				continue
+			}
+			nextDlg, err := open(next)
+			if err != nil {
+				missing[next] = err
+				continue
+			}
+			dialogs[next] = nextDlg
+			queue = append(queue, next)
+		}
+	}
+
+	for _, edge := range g.Edges {
+		target := g.Node(edge.Target)
+		if target.Kind != DLG_NODE_EXTERN {
+			continue
+		}
+		if err, ok := missing[target.Dialog]; ok {
+			problems = append(problems, DialogProblem{Kind: DLG_PROBLEM_MISSING_DIALOG, Node: edge.Source, Target: target.Dialog, Err: err})
+		} else {
+			problems = append(problems, DialogProblem{Kind: DLG_PROBLEM_STATE_RANGE, Node: edge.Source, Target: target.Id})
+		}
+	}
+	problems = append(problems, g.unreachable()...)
+	problems = append(problems, g.exitlessCycles()...)
+	return g, problems, nil
+}
+
+// Builds the graph of root and every dialog it leads to from the files in key
+func LoadDialogGraph(key *KEY, root string, tlk *TLK) (*DialogGraph, []DialogProblem, error) {
+	return BuildDialogGraph(root, func(name string) (*DLG, error) {
+		data, err := key.OpenFile(name + ".dlg")
+		if err != nil {
+			return nil, err
+		}
+		return OpenDlg(bytes.NewReader(data))
+	}, tlk)
+}
+
+func (g *DialogGraph) adjacency() map[string][]string {
+	adjacent := make(map[string][]string)
+	for _, edge := range g.Edges {
+		adjacent[edge.Source] = append(adjacent[edge.Source], edge.Target)
+	}
+	return adjacent
+}
+
+// Reports whether trigger can never be true, which is only known for a
+// False() outside of any OR
+func dlgFalseTrigger(trigger string) bool {
+	if strings.Contains(strings.ToUpper(trigger), "OR(") {
+		return false
+	}
+	for _, line := range strings.Split(trigger, "\n") {
+		if strings.EqualFold(strings.TrimSpace(line), "False()") {
+			return true
+		}
+	}
+	return false
+}
+
+// States that cannot be reached from the start of any dialog in the graph
+func (g *DialogGraph) unreachable() []DialogProblem {
+	adjacent := g.adjacency()
+	seen := make(map[string]bool)
+	queue := []string{}
+	for _, node := range g.Nodes {
+		if node.Kind == DLG_NODE_ROOT {
+			queue = append(queue, node.Id)
+			seen[node.Id] = true
+		}
+	}
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+		for _, next := range adjacent[id] {
+			if !seen[next] {
+				seen[next] = true
+				queue = append(queue, next)
+			}
+		}
+	}
+	problems := []DialogProblem{}
+	for _, node := range g.Nodes {
+		if node.Kind == DLG_NODE_STATE && !seen[node.Id] {
+			problems = append(problems, DialogProblem{Kind: DLG_PROBLEM_UNREACHABLE, Node: node.Id})
+		}
+	}
+	return problems
+}
+
+// Cycles that no path leads out of, found as strongly connected components
+// without an edge leaving them.  Edges with a False() trigger are never taken
+// and do not count as a way out.  Other triggers are assumed to be true at
+// some point.
+func (g *DialogGraph) exitlessCycles() []DialogProblem {
+	adjacent := make(map[string][]string)
+	for _, edge := range g.Edges {
+		if !dlgFalseTrigger(edge.Trigger) {
+			adjacent[edge.Source] = append(adjacent[edge.Source], edge.Target)
+		}
+	}
+	index := make(map[string]int)
+	low := make(map[string]int)
+	onStack := make(map[string]bool)
+	stack := []string{}
+	components := [][]string{}
+
+	var connect func(id string)
+	connect = func(id string) {
+		index[id] = len(index)
+		low[id] = index[id]
+		stack = append(stack, id)
+		onStack[id] = true
+		for _, next := range adjacent[id] {
+			if _, ok := index[next]; !ok {
+				connect(next)
+				if low[next] < low[id] {
+					low[id] = low[next]
+				}
+			} else if onStack[next] && index[next] < low[id] {
+				low[id] = index[next]
+			}
+		}
+		if low[id] == index[id] {
+			component := []string{}
+			for {
+				top := stack[len(stack)-1]
+				stack = stack[:len(stack)-1]
+				onStack[top] = false
+				component = append(component, top)
+				if top == id {
+					break
+				}
+			}
+			components = append(components, component)
+		}
+	}
+	for _, node := range g.Nodes {
+		if _, ok := index[node.Id]; !ok {
+			connect(node.Id)
+		}
+	}
+
+	problems := []DialogProblem{}
+	for _, component := range components {
+		members := make(map[string]bool)
+		for _, id := range component {
+			members[id] = true
+		}
+		leaves := false
+		looped := len(component) > 1
+		for _, id := range component {
+			for _, next := range adjacent[id] {
+				if !members[next] {
+					leaves = true
+				} else if next == id {
+					looped = true
+				}
+			}
+		}
+		if looped && !leaves {
+			sort.Strings(component)
+			problems = append(problems, DialogProblem{Kind: DLG_PROBLEM_NO_EXIT, Nodes: component})
+		}
+	}
+	return problems
+}
@@ -0,0 +1,184 @@
+package bg
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+const (
+	DLG_TRANS_TEXT      = 0x0001
+	DLG_TRANS_TRIGGER   = 0x0002
+	DLG_TRANS_ACTION    = 0x0004
+	DLG_TRANS_EXIT      = 0x0008
+	DLG_TRANS_JOURNAL   = 0x0010
+	DLG_TRANS_INTERRUPT = 0x0020
+	DLG_TRANS_UNSOLVED  = 0x0040
+	DLG_TRANS_NOTE      = 0x0080
+	DLG_TRANS_SOLVED    = 0x0100
+)
+
+// Transition flags expressed by the D syntax itself, anything else needs FLAGS
+const dlgTransImplied = DLG_TRANS_TEXT | DLG_TRANS_TRIGGER | DLG_TRANS_ACTION | DLG_TRANS_EXIT |
+	DLG_TRANS_JOURNAL | DLG_TRANS_UNSOLVED | DLG_TRANS_SOLVED
+
+type DlgDOptions struct {
+	// Used to add the text of each STRREF as a comment, or in place of the
+	// STRREF when InlineText is set
+	Tlk        *TLK
+	InlineText bool
+}
+
+// Quotes str with the first WeiDU string delimiter it does not contain
+func dString(str string) string {
+	for _, delim := range []string{"~", "%", "\""} {
+		if !strings.Contains(str, delim) {
+			return delim + str + delim
+		}
+	}
+	return "~~~~~" + str + "~~~~~"
+}
+
+func (opts *DlgDOptions) strref(id uint32) string {
+	if opts.Tlk == nil || int32(id) < 0 {
+		return fmt.Sprintf("#%d", int32(id))
+	}
+	str, err := opts.Tlk.String(int(id))
+	if err != nil {
+		return fmt.Sprintf("#%d", id)
+	}
+	sound := ""
+	if entry, _ := opts.Tlk.Entry(int(id)); entry != nil && entry.Sound.Valid() {
+		sound = " [" + entry.Sound.String() + "]"
+	}
+	if opts.InlineText {
+		return dString(str) + sound
+	}
+	return fmt.Sprintf("#%d /* %s%s */", id, dString(str), sound)
+}
+
+// Reports whether the states with triggers are not evaluated in state order,
+// in which case every triggered state needs an explicit WEIGHT
+func (dlg *DLG) needsWeights() bool {
+	last := int32(-1)
+	for _, state := range dlg.States {
+		if state.TriggerIndex < 0 {
+			continue
+		}
+		if state.TriggerIndex <= last {
+			return true
+		}
+		last = state.TriggerIndex
+	}
+	return false
+}
+
+func (dlg *DLG) stateTrigger(state DlgState) string {
+	if state.TriggerIndex >= 0 && int(state.TriggerIndex) < len(dlg.StateTriggers) {
+		return strings.TrimSpace(dlg.StateTriggers[state.TriggerIndex])
+	}
+	return ""
+}
+
+func (dlg *DLG) transitionTrigger(trans DlgTransition) string {
+	if trans.HasTrigger() && int(trans.TransitionTriggerIndex) < len(dlg.TransitionTriggers) {
+		return strings.TrimSpace(dlg.TransitionTriggers[trans.TransitionTriggerIndex])
+	}
+	return ""
+}
+
+func (dlg *DLG) transitionAction(trans DlgTransition) string {
+	if trans.HasAction() && int(trans.TransitionActionIndex) < len(dlg.Actions) {
+		return strings.TrimSpace(dlg.Actions[trans.TransitionActionIndex])
+	}
+	return ""
+}
+
+func (dlg *DLG) stateTransitions(state DlgState) []DlgTransition {
+	start := int(state.TransitionIndex)
+	end := start + int(state.TransitionCount)
+	if start > len(dlg.Transitions) {
+		start = len(dlg.Transitions)
+	}
+	if end > len(dlg.Transitions) {
+		end = len(dlg.Transitions)
+	}
+	return dlg.Transitions[start:end]
+}
+
+func (opts *DlgDOptions) transition(dlg *DLG, name string, trans DlgTransition) string {
+	out := "IF " + dString(dlg.transitionTrigger(trans)) + " THEN"
+	if trans.HasText() {
+		out += " REPLY " + opts.strref(trans.TransitionText)
+	}
+	if action := dlg.transitionAction(trans); action != "" {
+		out += " DO " + dString(action)
+	}
+	if trans.HasJournal() {
+		switch {
+		case trans.AddCompleteQuest():
+			out += " SOLVED_JOURNAL "
+		case trans.AddQuest():
+			out += " UNSOLVED_JOURNAL "
+		default:
+			out += " JOURNAL "
+		}
+		out += opts.strref(trans.JournalText)
+	}
+	if trans.Flags&^dlgTransImplied != 0 {
+		out += fmt.Sprintf(" FLAGS %d", trans.Flags)
+	}
+	if trans.TerminatesDialog() {
+		out += " EXIT"
+	} else if next := trans.NextDlg.String(); next != "" && !strings.EqualFold(next, name) {
+		out += fmt.Sprintf(" EXTERN %s %d", dString(strings.ToUpper(next)), trans.NextState)
+	} else {
+		out += fmt.Sprintf(" GOTO %d", trans.NextState)
+	}
+	return out
+}
+
+// Decompiles the dialog to WeiDU D source, name is the resource name of the
+// dialog and is used to tell GOTO from EXTERN transitions.
+func (dlg *DLG) WriteD(w io.Writer, name string, opts DlgDOptions) error {
+	name = strings.ToUpper(name)
+	from := make(map[int][]string)
+	for sIdx, state := range dlg.States {
+		for tIdx, trans := range dlg.stateTransitions(state) {
+			next := trans.NextDlg.String()
+			if !trans.TerminatesDialog() && (next == "" || strings.EqualFold(next, name)) {
+				from[int(trans.NextState)] = append(from[int(trans.NextState)], fmt.Sprintf("%d.%d", sIdx, tIdx))
+			}
+		}
+	}
+
+	out := "// creator  : bgfileformats\n"
+	out += "// argument : " + name + ".DLG\n\n"
+	out += "BEGIN " + dString(name)
+	if dlg.Header.Flags != 0 {
+		out += fmt.Sprintf(" %d", dlg.Header.Flags)
+	}
+	out += "\n"
+
+	weights := dlg.needsWeights()
+	for sIdx, state := range dlg.States {
+		out += "\nIF "
+		if weights && state.TriggerIndex >= 0 {
+			out += fmt.Sprintf("WEIGHT #%d ", state.TriggerIndex)
+		}
+		out += dString(dlg.stateTrigger(state)) + fmt.Sprintf(" THEN BEGIN %d", sIdx)
+		if refs := from[sIdx]; len(refs) > 0 {
+			sort.Strings(refs)
+			out += " // from: " + strings.Join(refs, " ")
+		}
+		out += "\n  SAY " + opts.strref(state.Stringref) + "\n"
+		for _, trans := range dlg.stateTransitions(state) {
+			out += "  " + opts.transition(dlg, name, trans) + "\n"
+		}
+		out += "END\n"
+	}
+
+	_, err := io.WriteString(w, out)
+	return err
+}
@@ -0,0 +1,304 @@
+package bg
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const (
+	DLG_NODE_ROOT = iota
+	DLG_NODE_STATE
+	DLG_NODE_REPLY
+	DLG_NODE_EXIT
+	DLG_NODE_EXTERN
+)
+
+var dlgNodeKinds = []string{"root", "state", "reply", "exit", "extern"}
+var dlgNodeColors = []string{"#000000", "#3366cc", "#999999", "#cc3333", "#33aa33"}
+
+// A DialogNode is the entry point of a dialog, one of its states, one of the
+// transitions leaving a state, the end of the dialog or a state in a dialog
+// that is not part of the graph.
+type DialogNode struct {
+	Id         string
+	Kind       int
+	Dialog     string
+	State      int
+	Transition int
+	Strref     int32
+	Text       string
+	Trigger    string
+	Action     string
+	Journal    int32
+	Flags      uint32
+}
+
+// Edges from the root carry the state trigger and its weight, edges from a
+// state to its transitions carry the transition trigger.  External edges lead
+// into another dialog.
+type DialogEdge struct {
+	Id       string
+	Source   string
+	Target   string
+	Trigger  string
+	Weight   int
+	External bool
+}
+
+type DialogGraph struct {
+	Nodes []DialogNode
+	Edges []DialogEdge
+	nodes map[string]int
+}
+
+func NewDialogGraph() *DialogGraph {
+	return &DialogGraph{nodes: make(map[string]int)}
+}
+
+func dlgStateId(dialog string, state int) string {
+	return fmt.Sprintf("%s_s%d", dialog, state)
+}
+
+func (g *DialogGraph) Node(id string) *DialogNode {
+	if idx, ok := g.nodes[id]; ok {
+		return &g.Nodes[idx]
+	}
+	return nil
+}
+
+// Adds node unless it already exists, a state replaces the extern
+// placeholder created when it was referenced from another dialog
+func (g *DialogGraph) addNode(node DialogNode) {
+	if idx, ok := g.nodes[node.Id]; ok {
+		if g.Nodes[idx].Kind == DLG_NODE_EXTERN && node.Kind != DLG_NODE_EXTERN {
+			g.Nodes[idx] = node
+		}
+		return
+	}
+	g.nodes[node.Id] = len(g.Nodes)
+	g.Nodes = append(g.Nodes, node)
+}
+
+func (g *DialogGraph) addEdge(source string, target string, trigger string, weight int) {
+	g.Edges = append(g.Edges, DialogEdge{Id: fmt.Sprintf("e%d", len(g.Edges)), Source: source, Target: target, Trigger: trigger, Weight: weight})
+}
+
+func dlgText(tlk *TLK, strref uint32) string {
+	if tlk == nil || int32(strref) < 0 {
+		return fmt.Sprintf("#%d", int32(strref))
+	}
+	return fetch(tlk, strref)
+}
+
+// Adds the states and transitions of dlg to the graph, name is the resource
+// name of the dialog and tlk is optional
+func (g *DialogGraph) AddDialog(name string, dlg *DLG, tlk *TLK) {
+	name = strings.ToUpper(name)
+	root := name
+	g.addNode(DialogNode{Id: root, Kind: DLG_NODE_ROOT, Dialog: name, State: -1, Transition: -1, Strref: -1, Journal: -1, Text: name})
+	for sIdx, state := range dlg.States {
+		stateId := dlgStateId(name, sIdx)
+		g.addNode(DialogNode{Id: stateId, Kind: DLG_NODE_STATE, Dialog: name, State: sIdx, Transition: -1,
+			Strref: int32(state.Stringref), Text: dlgText(tlk, state.Stringref), Trigger: dlg.stateTrigger(state), Journal: -1})
+		if state.TriggerIndex >= 0 {
+			g.addEdge(root, stateId, dlg.stateTrigger(state), int(state.TriggerIndex))
+		}
+
+		for tIdx, trans := range dlg.stateTransitions(state) {
+			node := DialogNode{Id: fmt.Sprintf("%s_t%d", stateId, tIdx), Kind: DLG_NODE_REPLY, Dialog: name, State: sIdx, Transition: tIdx,
+				Strref: -1, Journal: -1, Trigger: dlg.transitionTrigger(trans), Action: dlg.transitionAction(trans), Flags: trans.Flags}
+			if trans.HasText() {
+				node.Strref = int32(trans.TransitionText)
+				node.Text = dlgText(tlk, trans.TransitionText)
+			}
+			if trans.HasJournal() {
+				node.Journal = int32(trans.JournalText)
+			}
+			g.addNode(node)
+			g.addEdge(stateId, node.Id, node.Trigger, tIdx)
+
+			if trans.TerminatesDialog() {
+				exitId := name + "_exit"
+				g.addNode(DialogNode{Id: exitId, Kind: DLG_NODE_EXIT, Dialog: name, State: -1, Transition: -1, Strref: -1, Journal: -1, Text: "EXIT"})
+				g.addEdge(node.Id, exitId, "", 0)
+				continue
+			}
+			next := strings.ToUpper(trans.NextDlg.String())
+			if next == "" {
+				next = name
+			}
+			targetId := dlgStateId(next, int(trans.NextState))
+			g.addNode(DialogNode{Id: targetId, Kind: DLG_NODE_EXTERN, Dialog: next, State: int(trans.NextState), Transition: -1,
+				Strref: -1, Journal: -1, Text: targetId})
+			g.addEdge(node.Id, targetId, "", 0)
+			g.Edges[len(g.Edges)-1].External = next != name
+		}
+	}
+}
+
+// Builds the graph of a single dialog, transitions into other dialogs end in
+// extern nodes
+func (dlg *DLG) Graph(name string, tlk *TLK) *DialogGraph {
+	g := NewDialogGraph()
+	g.AddDialog(name, dlg, tlk)
+	return g
+}
+
+func dotQuote(str string) string {
+	str = strings.Replace(str, "\\", "\\\\", -1)
+	str = strings.Replace(str, "\"", "\\\"", -1)
+	str = strings.Replace(str, "\r", "", -1)
+	return "\"" + strings.Replace(str, "\n", "\\n", -1) + "\""
+}
+
+func (node *DialogNode) label() string {
+	label := node.Text
+	if node.Kind == DLG_NODE_REPLY {
+		if node.Strref < 0 {
+			label = ""
+		}
+		if node.Action != "" {
+			label += "\nDO " + node.Action
+		}
+		if node.Journal >= 0 {
+			label += fmt.Sprintf("\nJOURNAL #%d", node.Journal)
+		}
+	}
+	return strings.TrimSpace(label)
+}
+
+// Writes the graph in Graphviz DOT format
+func (g *DialogGraph) WriteDot(w io.Writer) error {
+	shapes := []string{"doublecircle", "box", "ellipse", "octagon", "box3d"}
+	out := "digraph dialog {\n"
+	for _, node := range g.Nodes {
+		out += fmt.Sprintf("\t%s [shape=%s label=%s];\n", dotQuote(node.Id), shapes[node.Kind], dotQuote(node.label()))
+	}
+	for _, edge := range g.Edges {
+		out += fmt.Sprintf("\t%s -> %s", dotQuote(edge.Source), dotQuote(edge.Target))
+		if edge.Trigger != "" {
+			out += fmt.Sprintf(" [label=%s]", dotQuote(edge.Trigger))
+		} else if edge.External {
+			out += " [style=dashed]"
+		}
+		out += ";\n"
+	}
+	out += "}\n"
+	_, err := io.WriteString(w, out)
+	return err
+}
+
+func xmlEscape(str string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(str))
+	return b.String()
+}
+
+// Writes the graph in GraphML format
+func (g *DialogGraph) WriteGraphML(w io.Writer) error {
+	out := xml.Header
+	out += "<graphml xmlns=\"http://graphml.graphdrawing.org/xmlns\">\n"
+	for _, key := range []string{"kind", "dialog", "text", "trigger", "action"} {
+		out += fmt.Sprintf("\t<key id=\"%s\" for=\"all\" attr.name=\"%s\" attr.type=\"string\"/>\n", key, key)
+	}
+	out += "\t<key id=\"strref\" for=\"node\" attr.name=\"strref\" attr.type=\"int\"/>\n"
+	out += "\t<key id=\"weight\" for=\"edge\" attr.name=\"weight\" attr.type=\"int\"/>\n"
+	out += "\t<graph id=\"dialog\" edgedefault=\"directed\">\n"
+	for _, node := range g.Nodes {
+		out += fmt.Sprintf("\t\t<node id=\"%s\">\n", xmlEscape(node.Id))
+		out += fmt.Sprintf("\t\t\t<data key=\"kind\">%s</data>\n", dlgNodeKinds[node.Kind])
+		out += fmt.Sprintf("\t\t\t<data key=\"dialog\">%s</data>\n", xmlEscape(node.Dialog))
+		if node.Strref >= 0 {
+			out += fmt.Sprintf("\t\t\t<data key=\"strref\">%d</data>\n", node.Strref)
+		}
+		for _, data := range [][2]string{{"text", node.Text}, {"trigger", node.Trigger}, {"action", node.Action}} {
+			if data[1] != "" {
+				out += fmt.Sprintf("\t\t\t<data key=\"%s\">%s</data>\n", data[0], xmlEscape(data[1]))
+			}
+		}
+		out += "\t\t</node>\n"
+	}
+	for _, edge := range g.Edges {
+		out += fmt.Sprintf("\t\t<edge id=\"%s\" source=\"%s\" target=\"%s\">\n", edge.Id, xmlEscape(edge.Source), xmlEscape(edge.Target))
+		out += fmt.Sprintf("\t\t\t<data key=\"weight\">%d</data>\n", edge.Weight)
+		if edge.Trigger != "" {
+			out += fmt.Sprintf("\t\t\t<data key=\"trigger\">%s</data>\n", xmlEscape(edge.Trigger))
+		}
+		out += "\t\t</edge>\n"
+	}
+	out += "\t</graph>\n</graphml>\n"
+	_, err := io.WriteString(w, out)
+	return err
+}
+
+// Lays the nodes out in columns by distance from the first node
+func (g *DialogGraph) layout() map[string][2]int {
+	pos := make(map[string][2]int)
+	adjacent := make(map[string][]string)
+	for _, edge := range g.Edges {
+		adjacent[edge.Source] = append(adjacent[edge.Source], edge.Target)
+	}
+	rows := []int{}
+	for _, node := range g.Nodes {
+		if _, ok := pos[node.Id]; ok {
+			continue
+		}
+		queue := []string{node.Id}
+		depth := map[string]int{node.Id: 0}
+		for len(queue) > 0 {
+			id := queue[0]
+			queue = queue[1:]
+			if _, ok := pos[id]; ok {
+				continue
+			}
+			d := depth[id]
+			for len(rows) <= d {
+				rows = append(rows, 0)
+			}
+			pos[id] = [2]int{d, rows[d]}
+			rows[d]++
+			for _, next := range adjacent[id] {
+				if _, ok := pos[next]; !ok {
+					if _, seen := depth[next]; !seen {
+						depth[next] = d + 1
+						queue = append(queue, next)
+					}
+				}
+			}
+		}
+	}
+	return pos
+}
+
+// Builds the sigma.js graph used by ToJson
+func (g *DialogGraph) sigma() dlgGraph {
+	var graph dlgGraph
+	pos := g.layout()
+	for _, node := range g.Nodes {
+		size := float32(1)
+		if node.Kind != DLG_NODE_REPLY {
+			size = 2
+		}
+		graph.Nodes = append(graph.Nodes, dlgNode{
+			X: float32(pos[node.Id][0]), Y: float32(pos[node.Id][1]),
+			Label: node.label(), Id: node.Id, Color: dlgNodeColors[node.Kind], Size: size,
+		})
+	}
+	for _, edge := range g.Edges {
+		graph.Edges = append(graph.Edges, dlgEdge{Id: edge.Id, Source: edge.Source, Target: edge.Target})
+	}
+	return graph
+}
+
+// Writes the graph as sigma.js JSON
+func (g *DialogGraph) WriteSigmaJson(w io.Writer) error {
+	bytes, err := json.MarshalIndent(g.sigma(), "", "\t")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(bytes)
+	return err
+}
@@ -0,0 +1,118 @@
+package bg
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Gives stateIdx trigger, inserted at pos in the state trigger table so it is
+// evaluated before the trigger currently at pos.  The states using later
+// triggers are renumbered to match.
+func (dlg *DLG) InsertStateTrigger(stateIdx int, pos int, trigger string) error {
+	if stateIdx < 0 || stateIdx >= len(dlg.States) {
+		return fmt.Errorf("State out of range: %d >= %d", stateIdx, len(dlg.States))
+	}
+	if pos < 0 || pos > len(dlg.StateTriggers) {
+		pos = len(dlg.StateTriggers)
+	}
+	dlg.StateTriggers = append(dlg.StateTriggers, "")
+	copy(dlg.StateTriggers[pos+1:], dlg.StateTriggers[pos:])
+	dlg.StateTriggers[pos] = trigger
+	for idx := range dlg.States {
+		if dlg.States[idx].TriggerIndex >= int32(pos) {
+			dlg.States[idx].TriggerIndex++
+		}
+	}
+	dlg.States[stateIdx].TriggerIndex = int32(pos)
+	return nil
+}
+
+// Returns a transition using trigger and action, either may be empty.  The
+// caller fills in the text, journal and target.
+func (dlg *DLG) NewTransition(trigger string, action string) DlgTransition {
+	trans := DlgTransition{}
+	if trigger != "" {
+		trans.Flags |= DLG_TRANS_TRIGGER
+		trans.TransitionTriggerIndex = dlg.AddTransitionTrigger(trigger)
+	}
+	if action != "" {
+		trans.Flags |= DLG_TRANS_ACTION
+		trans.TransitionActionIndex = dlg.AddAction(action)
+	}
+	return trans
+}
+
+// Copies a transition of src into dlg, its trigger and action strings are
+// added to dlg
+func (dlg *DLG) CopyTransition(src *DLG, trans DlgTransition) DlgTransition {
+	if trans.HasTrigger() && int(trans.TransitionTriggerIndex) < len(src.TransitionTriggers) {
+		trans.TransitionTriggerIndex = dlg.AddTransitionTrigger(src.TransitionTriggers[trans.TransitionTriggerIndex])
+	}
+	if trans.HasAction() && int(trans.TransitionActionIndex) < len(src.Actions) {
+		trans.TransitionActionIndex = dlg.AddAction(src.Actions[trans.TransitionActionIndex])
+	}
+	return trans
+}
+
+// Inserts transitions before the existing ones of the state as WeiDU
+// EXTEND_TOP does
+func (dlg *DLG) ExtendTop(stateIdx int, transitions []DlgTransition) error {
+	return dlg.InsertTransitions(stateIdx, 0, transitions)
+}
+
+// Adds transitions after the existing ones of the state as WeiDU
+// EXTEND_BOTTOM does
+func (dlg *DLG) ExtendBottom(stateIdx int, transitions []DlgTransition) error {
+	return dlg.InsertTransitions(stateIdx, -1, transitions)
+}
+
+// Removes the transition at pos from the state, the transition indexes of
+// the states that follow are shifted to match
+func (dlg *DLG) RemoveTransition(stateIdx int, pos int) error {
+	if stateIdx < 0 || stateIdx >= len(dlg.States) {
+		return fmt.Errorf("State out of range: %d >= %d", stateIdx, len(dlg.States))
+	}
+	state := &dlg.States[stateIdx]
+	if pos < 0 || pos >= int(state.TransitionCount) {
+		return fmt.Errorf("Transition out of range: %d >= %d", pos, state.TransitionCount)
+	}
+	at := int(state.TransitionIndex) + pos
+	dlg.Transitions = append(dlg.Transitions[:at], dlg.Transitions[at+1:]...)
+	for idx := range dlg.States {
+		if idx != stateIdx && int(dlg.States[idx].TransitionIndex) > at {
+			dlg.States[idx].TransitionIndex--
+		}
+	}
+	state.TransitionCount--
+	return nil
+}
+
+// Appends every state of other to dlg and returns the index the first of
+// them received.  Transitions of other leading to otherName are retargeted to
+// name, the appended state triggers keep their relative order after the
+// existing ones.
+func (dlg *DLG) AppendDialog(other *DLG, name string, otherName string) int {
+	offset := len(dlg.States)
+	for _, state := range other.States {
+		transitions := []DlgTransition{}
+		for _, trans := range other.stateTransitions(state) {
+			trans = dlg.CopyTransition(other, trans)
+			next := trans.NextDlg.String()
+			if !trans.TerminatesDialog() && (next == "" || strings.EqualFold(next, otherName)) {
+				trans.NextDlg = NewResref(strings.ToUpper(name))
+				trans.NextState += uint32(offset)
+			}
+			transitions = append(transitions, trans)
+		}
+		dlg.AppendState(DlgState{Stringref: state.Stringref, TriggerIndex: -1}, transitions)
+	}
+
+	base := len(dlg.StateTriggers)
+	dlg.StateTriggers = append(dlg.StateTriggers, other.StateTriggers...)
+	for idx, state := range other.States {
+		if state.TriggerIndex >= 0 && int(state.TriggerIndex) < len(other.StateTriggers) {
+			dlg.States[offset+idx].TriggerIndex = int32(base) + state.TriggerIndex
+		}
+	}
+	return offset
+}
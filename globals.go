@@ -0,0 +1,299 @@
+package bg
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	VAR_CHECK = iota
+	VAR_SET
+	VAR_INCREMENT
+	VAR_TIMER
+	VAR_INITIAL
+)
+
+// A VarRef is a single use of a variable, Call is the trigger or action and
+// Value the text of its value argument
+type VarRef struct {
+	Kind   int
+	Call   string
+	Value  string
+	Source string
+	Line   int
+}
+
+// Scope is GLOBAL, LOCALS, MYAREA or the name of an area.  Initial holds the
+// value an area variable starts with.
+type Variable struct {
+	Name       string
+	Scope      string
+	HasInitial bool
+	Initial    int32
+	Refs       []VarRef
+}
+
+type VarIndex struct {
+	IDS  *ScriptIDS
+	vars map[string]*Variable
+}
+
+func NewVarIndex(ids *ScriptIDS) *VarIndex {
+	return &VarIndex{IDS: ids, vars: make(map[string]*Variable)}
+}
+
+// Returns the variable, names and scopes are not case sensitive
+func (vi *VarIndex) Variable(name string, scope string) *Variable {
+	return vi.vars[strings.ToUpper(scope)+":"+strings.ToUpper(name)]
+}
+
+func (vi *VarIndex) variable(name string, scope string) *Variable {
+	v := vi.Variable(name, scope)
+	if v == nil {
+		v = &Variable{Name: name, Scope: strings.ToUpper(scope)}
+		vi.vars[strings.ToUpper(scope)+":"+strings.ToUpper(name)] = v
+	}
+	return v
+}
+
+// Returns every variable ordered by scope then name
+func (vi *VarIndex) Variables() []*Variable {
+	vars := make([]*Variable, 0, len(vi.vars))
+	for _, v := range vi.vars {
+		vars = append(vars, v)
+	}
+	sort.Slice(vars, func(i, j int) bool {
+		if vars[i].Scope != vars[j].Scope {
+			return vars[i].Scope < vars[j].Scope
+		}
+		return strings.ToUpper(vars[i].Name) < strings.ToUpper(vars[j].Name)
+	})
+	return vars
+}
+
+func varKind(call string, action bool) int {
+	switch {
+	case !action:
+		return VAR_CHECK
+	case strings.HasPrefix(strings.ToLower(call), "increment"):
+		return VAR_INCREMENT
+	case strings.Contains(strings.ToLower(call), "timer"):
+		return VAR_TIMER
+	}
+	return VAR_SET
+}
+
+// Records the variable used by call, variables are the S:Name argument
+// followed by S:Area giving the scope
+func (vi *VarIndex) addCall(source string, call *ScriptCall, action bool) {
+	if action && strings.EqualFold(call.Name, "ActionOverride") {
+		if len(call.Args) == 2 && call.Args[1].Kind == SCRIPT_ARG_CALL {
+			vi.addCall(source, call.Args[1].Call, true)
+		}
+		return
+	}
+	entry := vi.IDS.Trigger.ByName(call.Name)
+	if action {
+		entry = vi.IDS.Action.ByName(call.Name)
+	}
+	if entry == nil {
+		return
+	}
+	for idx := 1; idx < len(entry.Args) && idx < len(call.Args); idx++ {
+		name, area := entry.Args[idx-1], entry.Args[idx]
+		if name.Type != IDS_STRING || area.Type != IDS_STRING || !strings.EqualFold(area.Name, "Area") {
+			continue
+		}
+		if call.Args[idx-1].Kind != SCRIPT_ARG_STRING || call.Args[idx].Kind != SCRIPT_ARG_STRING {
+			continue
+		}
+		ref := VarRef{Kind: varKind(entry.Name, action), Call: entry.Name, Source: source, Line: call.Line}
+		for _, arg := range call.Args[idx+1:] {
+			if arg.Kind == SCRIPT_ARG_INT || arg.Kind == SCRIPT_ARG_SYMBOL {
+				ref.Value = arg.String()
+				break
+			}
+		}
+		v := vi.variable(call.Args[idx-1].Str, call.Args[idx].Str)
+		v.Refs = append(v.Refs, ref)
+	}
+}
+
+// Records the variables used by a compiled trigger or action, strs are its
+// stored strings and ints its stored integers.  A S:Area argument shares the
+// string of the S:Name before it, the scope taking the first six characters.
+// Strings too short to hold a name after the scope are skipped.
+func (vi *VarIndex) addBcsCall(source string, line int, entry *IdsEntry, action bool, strs []string, ints []int) {
+	nInts := 0
+	for idx, arg := range entry.Args {
+		switch {
+		case arg.Type == IDS_INT:
+			nInts++
+		case arg.Type == IDS_STRING && idx > 0 && strings.EqualFold(arg.Name, "Area") && entry.Args[idx-1].Type == IDS_STRING:
+			str := ""
+			if len(strs) > 0 {
+				str, strs = strs[0], strs[1:]
+			}
+			if len(str) <= 6 {
+				continue
+			}
+			scope := str[:6]
+			ref := VarRef{Kind: varKind(entry.Name, action), Call: entry.Name, Source: source, Line: line}
+			valueInt := nInts
+			for _, next := range entry.Args[idx+1:] {
+				if next.Type != IDS_INT {
+					continue
+				}
+				if valueInt < len(ints) {
+					ref.Value = strconv.Itoa(ints[valueInt])
+					if name, ok := vi.IDS.symbolName(next.Specifics, ints[valueInt]); ok {
+						ref.Value = name
+					}
+				}
+				break
+			}
+			v := vi.variable(str[len(scope):], scope)
+			v.Refs = append(v.Refs, ref)
+		case arg.Type == IDS_STRING && (idx+1 >= len(entry.Args) || !strings.EqualFold(entry.Args[idx+1].Name, "Area") || entry.Args[idx+1].Type != IDS_STRING):
+			if len(strs) > 0 {
+				strs = strs[1:]
+			}
+		}
+	}
+}
+
+// Adds the variables used by a compiled script, lines are those of the
+// decompiled block.  Triggers and actions missing from the IDS are skipped,
+// the first of them is returned once the rest of the script is indexed.
+func (vi *VarIndex) AddBcs(name string, bcs *BCS) error {
+	var err error
+	for bIdx, block := range bcs.Blocks {
+		source := fmt.Sprintf("%s block %d", name, bIdx)
+		line := 2
+		for _, trig := range block.Triggers {
+			if entry := vi.IDS.Trigger.ByID(trig.Id); entry != nil {
+				vi.addBcsCall(source, line, entry, false, []string{trig.Str1, trig.Str2}, []int{trig.Int1, trig.Int2, trig.Int3})
+			} else if err == nil {
+				err = fmt.Errorf("%s: unknown trigger 0x%04x", source, trig.Id)
+			}
+			line++
+		}
+		for _, resp := range block.Responses {
+			line++
+			for _, act := range resp.Actions {
+				line++
+				if entry := vi.IDS.Action.ByID(act.Id); entry != nil {
+					vi.addBcsCall(source, line, entry, true, []string{act.Str1, act.Str2}, []int{act.Int1, act.Int2, act.Int3})
+				} else if err == nil {
+					err = fmt.Errorf("%s: unknown action %d", source, act.Id)
+				}
+			}
+		}
+	}
+	return err
+}
+
+func (vi *VarIndex) addDlgString(source string, str string, action bool) error {
+	parse := ParseTriggers
+	if action {
+		parse = ParseActions
+	}
+	calls, err := parse(str)
+	if err != nil {
+		return fmt.Errorf("%s: %v", source, err)
+	}
+	for _, call := range calls {
+		vi.addCall(source, call, action)
+	}
+	return nil
+}
+
+// Adds the variables used by the triggers and actions of a dialog.  Strings
+// that cannot be parsed are skipped, the first error is returned once the
+// rest of the dialog is indexed.
+func (vi *VarIndex) AddDlg(name string, dlg *DLG) error {
+	var first error
+	add := func(source string, str string, action bool) {
+		if err := vi.addDlgString(source, str, action); err != nil && first == nil {
+			first = err
+		}
+	}
+	for sIdx, state := range dlg.States {
+		if state.TriggerIndex >= 0 && int(state.TriggerIndex) < len(dlg.StateTriggers) {
+			add(fmt.Sprintf("%s state %d", name, sIdx), dlg.StateTriggers[state.TriggerIndex], false)
+		}
+		for tIdx, trans := range dlg.stateTransitions(state) {
+			source := fmt.Sprintf("%s state %d transition %d", name, sIdx, tIdx)
+			add(source, dlg.transitionTrigger(trans), false)
+			add(source, dlg.transitionAction(trans), true)
+		}
+	}
+	return first
+}
+
+// Seeds the initial values of the variables stored in an area, name is the
+// area resource which is also the scope of its variables
+func (vi *VarIndex) AddArea(name string, area *Area) {
+	scope := strings.ToUpper(strings.TrimSuffix(name, filepath.Ext(name)))
+	for _, av := range area.Variables {
+		v := vi.variable(av.Name.String(), scope)
+		v.HasInitial = true
+		v.Initial = av.IntValue
+		v.Refs = append(v.Refs, VarRef{Kind: VAR_INITIAL, Value: fmt.Sprintf("%d", av.IntValue), Source: scope + ".ARE"})
+	}
+}
+
+// Indexes every script, dialog and area in key.  Files that cannot be read
+// or that use calls missing from the IDS are reported in the returned errors,
+// everything else in them is still indexed.
+func BuildVarIndex(key *KEY, ids *ScriptIDS) (*VarIndex, []error) {
+	files := []string{}
+	for _, ext := range []string{"are", "bcs", "dlg"} {
+		files = append(files, key.GetFilesByType(fileTypes[ext])...)
+	}
+	return buildVarIndex(files, key.OpenFile, ids)
+}
+
+func buildVarIndex(files []string, open func(name string) ([]byte, error), ids *ScriptIDS) (*VarIndex, []error) {
+	vi := NewVarIndex(ids)
+	errs := []error{}
+	for _, file := range files {
+		data, err := open(file)
+		if err == nil {
+			err = vi.addFile(file, data)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", file, err))
+		}
+	}
+	return vi, errs
+}
+
+func (vi *VarIndex) addFile(file string, data []byte) error {
+	name := strings.ToUpper(file)
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".are":
+		area, err := OpenArea(bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		vi.AddArea(file, area)
+	case ".bcs":
+		bcs, err := OpenBCS(bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		return vi.AddBcs(name, bcs)
+	case ".dlg":
+		dlg, err := OpenDlg(bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		return vi.AddDlg(name, dlg)
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package bg
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestVarIndex(t *testing.T) {
+	ids := newTestScriptIDS(t)
+	ids.Action.Add(109, "IncrementGlobal").Args = []IdsArg{{Type: IDS_STRING, Name: "Name"}, {Type: IDS_STRING, Name: "Area"}, {Type: IDS_INT, Name: "Value"}}
+	vi := NewVarIndex(ids)
+	bcs, err := OpenBCS(strings.NewReader(testBcs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = vi.AddBcs("TEST.BCS", bcs); err != nil {
+		t.Fatal(err)
+	}
+	dlg := &DLG{
+		States:             []DlgState{{TriggerIndex: 0, TransitionCount: 1}},
+		Transitions:        []DlgTransition{{Flags: DLG_TRANS_TRIGGER | DLG_TRANS_ACTION | DLG_TRANS_EXIT}},
+		StateTriggers:      []string{"Global(\"myvar\",\"global\",2)"},
+		TransitionTriggers: []string{"!Global(\"Done\",\"AR0602\",0)"},
+		Actions:            []string{"IncrementGlobal(\"MyVar\",\"GLOBAL\",1)"},
+	}
+	if err = vi.AddDlg("TEST.DLG", dlg); err != nil {
+		t.Fatal(err)
+	}
+	area := &Area{Variables: []areaVariable{{IntValue: 5}}}
+	copy(area.Variables[0].Name.Value[:], "Done")
+	vi.AddArea("ar0602.are", area)
+
+	v := vi.Variable("MYVAR", "Global")
+	if v == nil || len(v.Refs) != 3 {
+		t.Fatalf("Bad variable: %+v", v)
+	}
+	if v.Refs[0].Kind != VAR_CHECK || v.Refs[0].Source != "TEST.BCS block 0" || v.Refs[0].Line != 2 || v.Refs[0].Value != "0" {
+		t.Errorf("Bad check: %+v", v.Refs[0])
+	}
+	if v.Refs[2].Kind != VAR_INCREMENT || v.Refs[2].Source != "TEST.DLG state 0 transition 0" || v.Refs[2].Value != "1" {
+		t.Errorf("Bad increment: %+v", v.Refs[2])
+	}
+	if v := vi.Variable("Done", "LOCALS"); v == nil || v.Refs[0].Kind != VAR_SET || v.Refs[0].Call != "SetGlobal" {
+		t.Errorf("Bad local: %+v", v)
+	}
+	if v := vi.Variable("done", "ar0602"); v == nil || !v.HasInitial || v.Initial != 5 || len(v.Refs) != 2 {
+		t.Errorf("Bad area variable: %+v", v)
+	}
+	if vars := vi.Variables(); len(vars) != 3 || vars[0].Scope != "AR0602" || vars[2].Scope != "LOCALS" {
+		t.Errorf("Bad order: %+v", vars)
+	}
+
+	badBcs := strings.Replace(testBcs, "16399 0 0", "1234 0 0", 1)
+	badDlg := *dlg
+	badDlg.StateTriggers = []string{"Global(\"myvar\""}
+	var dlgBuf bytes.Buffer
+	if err = badDlg.Write(&dlgBuf); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{"BAD.BCS": []byte(badBcs), "BAD.DLG": dlgBuf.Bytes(), "BROKEN.DLG": []byte("DLG V1.0")}
+	vi, errs := buildVarIndex([]string{"BAD.BCS", "MISSING.BCS", "BROKEN.DLG", "BAD.DLG"}, func(name string) ([]byte, error) {
+		if data, ok := files[name]; ok {
+			return data, nil
+		}
+		return nil, fmt.Errorf("not found")
+	}, ids)
+	if len(errs) != 4 {
+		t.Errorf("Expected an error for each file: %v", errs)
+	}
+	if v := vi.Variable("Done", "LOCALS"); v == nil || len(v.Refs) != 1 || v.Refs[0].Source != "BAD.BCS block 0" || v.Refs[0].Line != 6 {
+		t.Errorf("Script with unknown trigger not indexed: %+v", v)
+	}
+	if v := vi.Variable("MyVar", "GLOBAL"); v == nil || len(v.Refs) != 1 || v.Refs[0].Kind != VAR_INCREMENT {
+		t.Errorf("Dialog with bad trigger not indexed: %+v", v)
+	}
+
+	count := len(vi.Variables())
+	vi.addBcsCall("SHORT.BCS", 1, ids.Action.ByName("IncrementGlobal"), true, []string{"GLOBAL"}, []int{1})
+	if len(vi.Variables()) != count || vi.Variable("", "GLOBAL") != nil {
+		t.Errorf("Variable added without a name: %+v", vi.Variables())
+	}
+}
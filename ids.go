@@ -2,27 +2,60 @@ package bg
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
 	"io"
-	"log"
+	"io/ioutil"
 	"strconv"
 	"strings"
 )
 
-type idsEntry struct {
-	Id   int
-	Name string
-	Args []idsArg
+// IdText is the id as written in the file, it is kept so hex and decimal ids
+// are written back unchanged.  Args is nil unless the entry is a function.
+type IdsEntry struct {
+	Id     int
+	IdText string
+	Name   string
+	Args   []IdsArg
+	raw    string
+	orig   string
+	before []string
 }
 
-// Can be one of Object, Point, String, Integer
-type idsArg struct {
-	Type int
-	Name string
+// Can be one of Object, Point, String, Integer.  Specifics is the IDS file
+// named after the *, as in I:Style*AStyles.
+type IdsArg struct {
+	Type      int
+	Name      string
+	Specifics string
 }
 
+// IdsError describes a line OpenIDS could not make sense of
+type IdsError struct {
+	Line int
+	Text string
+	Msg  string
+}
+
+func (e IdsError) Error() string {
+	return fmt.Sprintf("line %d: %s: %q", e.Line, e.Msg, e.Text)
+}
+
+// Header is the signature line, empty for files without one.  HasCount is set
+// when the signature is followed by the number of entries, which is updated
+// on write.  Lines that could not be parsed are skipped and reported in
+// Warnings, they are written back unchanged along with blank lines.  Encrypted
+// files are written encrypted again unless Encrypted is cleared.
 type IDS struct {
-	Entries []idsEntry
+	Header    string
+	HasCount  bool
+	Entries   []IdsEntry
+	Warnings  []IdsError
+	Encrypted bool
+	prelude   []string
+	countLine string
+	trailer   []string
+	newline   string
 }
 
 const (
@@ -47,67 +80,338 @@ func typeToId(name string) int {
 	case "I":
 		return IDS_INT
 	default:
-		log.Printf("WTF? : %s", name)
 		return IDS_UNKNOWN
 	}
-
 }
 
-func strToArg(arg string) (*idsArg, error) {
-	argChunks := strings.Split(arg, ":")
+func strToArg(arg string) (*IdsArg, error) {
+	argChunks := strings.Split(strings.TrimSpace(arg), ":")
 	if len(argChunks) != 2 {
-		return nil, fmt.Errorf("Arg: [%s], could not be split on :", arg)
+		return nil, fmt.Errorf("argument could not be split on :")
+	}
+	argType := typeToId(strings.ToUpper(argChunks[0]))
+	if argType == IDS_UNKNOWN {
+		return nil, fmt.Errorf("unknown argument type %s", argChunks[0])
+	}
+	nameChunks := strings.SplitN(argChunks[1], "*", 2)
+	idsArg := &IdsArg{Type: argType, Name: nameChunks[0]}
+	if len(nameChunks) == 2 {
+		idsArg.Specifics = nameChunks[1]
 	}
-	nameChunks := strings.Split(argChunks[1], "*")
+	return idsArg, nil
+}
 
-	return &idsArg{Type: typeToId(argChunks[0]), Name: nameChunks[0]}, nil
+func isIdsCount(line string) bool {
+	_, err := strconv.Atoi(strings.TrimSpace(line))
+	return err == nil
 }
 
-func OpenIDS(r io.ReadSeeker) (*IDS, error) {
-	scanner := bufio.NewScanner(r)
+func (ids *IDS) parseEntry(lineNum int, line string) {
+	warn := func(format string, args ...interface{}) {
+		ids.Warnings = append(ids.Warnings, IdsError{Line: lineNum, Text: line, Msg: fmt.Sprintf(format, args...)})
+	}
+	words := strings.Fields(line)
+	if len(words) < 2 {
+		warn("missing name")
+		return
+	}
+	num, err := strconv.ParseInt(words[0], 0, 64)
+	if err != nil {
+		warn("bad id")
+		return
+	}
+	name := strings.TrimSpace(strings.TrimSpace(line)[len(words[0]):])
+	if ids.prelude != nil {
+		// 2DA style files have the name in the first column after the label
+		name = words[1]
+	}
 
-	ids := IDS{}
+	chunks := strings.Split(name, "(")
+	switch len(chunks) {
+	case 1:
+		ids.Entries = append(ids.Entries, IdsEntry{Id: int(num), IdText: words[0], Name: name})
+	case 2:
+		if !strings.HasSuffix(chunks[1], ")") {
+			warn("missing )")
+			return
+		}
+		e := IdsEntry{Id: int(num), IdText: words[0], Name: strings.TrimSpace(chunks[0]), Args: []IdsArg{}}
+		for _, arg := range strings.Split(strings.TrimSuffix(chunks[1], ")"), ",") {
+			if strings.TrimSpace(arg) == "" {
+				continue
+			}
+			idsArg, err := strToArg(arg)
+			if err != nil {
+				warn("%s: %v", arg, err)
+				return
+			}
+			e.Args = append(e.Args, *idsArg)
+		}
+		ids.Entries = append(ids.Entries, e)
+	default:
+		warn("too many (")
+	}
+}
 
-	// Read header
-	scanner.Scan()
+// Reads an IDS file, the "IDS V1.0" signature and the count line are optional
+// and 2DA style and encrypted files are accepted
+func OpenIDS(r io.ReadSeeker) (*IDS, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	ids := IDS{newline: "\n", Encrypted: IsEncrypted(data)}
+	data = Decrypt(data)
+	if bytes.Contains(data, []byte("\r\n")) {
+		ids.newline = "\r\n"
+	}
 
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	lines := []string{}
 	for scanner.Scan() {
-		words := strings.SplitN(scanner.Text(), " ", 2)
-		if len(words) != 2 {
-			log.Printf("unable to split text: %s [%q]", scanner.Text(), words)
-			continue
+		lines = append(lines, scanner.Text())
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	start := 0
+	if len(lines) > 0 {
+		header := strings.ToUpper(strings.TrimSpace(lines[0]))
+		switch {
+		case strings.HasPrefix(header, "2DA"):
+			if len(lines) < 3 {
+				return nil, fmt.Errorf("2DA style IDS is missing its default and column lines")
+			}
+			ids.Header = lines[0]
+			ids.prelude = lines[1:3]
+			start = 3
+		case strings.HasPrefix(header, "IDS"):
+			ids.Header = lines[0]
+			start = 1
+			if len(lines) > 1 && isIdsCount(lines[1]) {
+				ids.HasCount = true
+				ids.countLine = lines[1]
+				start = 2
+			}
+		case isIdsCount(header):
+			ids.HasCount = true
+			ids.countLine = lines[0]
+			start = 1
+		}
+	}
+
+	other := []string{}
+	for idx := start; idx < len(lines); idx++ {
+		count := len(ids.Entries)
+		if strings.TrimSpace(lines[idx]) != "" {
+			ids.parseEntry(idx+1, lines[idx])
 		}
-		num, err := strconv.ParseUint(words[0], 0, 32)
-		if err != nil {
-			log.Printf("Unable to convert to number: %+v", err)
+		if len(ids.Entries) == count {
+			other = append(other, lines[idx])
 			continue
 		}
+		entry := &ids.Entries[count]
+		entry.raw, entry.before = lines[idx], other
+		entry.orig = ids.entryLine(entry)
+		other = nil
+	}
+	ids.trailer = other
+	return &ids, nil
+}
+
+// Like OpenIDS but fails on the first line that could not be parsed
+func OpenIDSStrict(r io.ReadSeeker) (*IDS, error) {
+	ids, err := OpenIDS(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(ids.Warnings) > 0 {
+		return nil, ids.Warnings[0]
+	}
+	return ids, nil
+}
+
+// Returns the first entry with the id, several entries may share an id
+func (ids *IDS) ByID(id int) *IdsEntry {
+	if ids == nil {
+		return nil
+	}
+	for idx := range ids.Entries {
+		if ids.Entries[idx].Id == id {
+			return &ids.Entries[idx]
+		}
+	}
+	return nil
+}
+
+// Returns every entry with the id in file order
+func (ids *IDS) EntriesByID(id int) []*IdsEntry {
+	entries := []*IdsEntry{}
+	if ids == nil {
+		return entries
+	}
+	for idx := range ids.Entries {
+		if ids.Entries[idx].Id == id {
+			entries = append(entries, &ids.Entries[idx])
+		}
+	}
+	return entries
+}
+
+// Returns the entry named name, names are not case sensitive
+func (ids *IDS) ByName(name string) *IdsEntry {
+	if ids == nil {
+		return nil
+	}
+	for idx := range ids.Entries {
+		if strings.EqualFold(ids.Entries[idx].Name, name) {
+			return &ids.Entries[idx]
+		}
+	}
+	return nil
+}
 
-		chunks := strings.Split(words[1], "(")
-		// No arguments
-		if len(chunks) == 1 {
-			ids.Entries = append(ids.Entries, idsEntry{Id: int(num), Name: chunks[0]})
-			// Has arguments
-		} else if len(chunks) == 2 {
-			function := chunks[0]
-			strArgs := strings.Split(strings.TrimRight(chunks[1], ")"), ",")
-			e := idsEntry{Id: int(num), Name: function}
-			for _, arg := range strArgs {
-				if arg != "" {
-					args, err := strToArg(arg)
-					if err != nil {
-						log.Printf("Error converting %s to %+v %+v %+v", arg, err, strArgs, chunks)
-					} else {
-						e.Args = append(e.Args, *args)
-					}
-				}
+// Parses a number or looks up a name
+func (ids *IDS) value(field string) (int, bool) {
+	if v, err := strconv.ParseInt(field, 0, 32); err == nil {
+		return int(v), true
+	}
+	if entry := ids.ByName(field); entry != nil {
+		return entry.Id, true
+	}
+	return 0, false
+}
+
+func editDistance(a string, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = prev[j-1] + cost
+			if prev[j]+1 < cur[j] {
+				cur[j] = prev[j] + 1
+			}
+			if cur[j-1]+1 < cur[j] {
+				cur[j] = cur[j-1] + 1
 			}
-			ids.Entries = append(ids.Entries, e)
-		} else {
-			log.Printf("Error splitting text: %s", words[1])
-			continue
 		}
+		prev = cur
 	}
+	return prev[len(b)]
+}
 
-	return &ids, nil
+// Returns ", did you mean X?" naming the entry closest to a misspelled name,
+// or nothing when no entry is close
+func (ids *IDS) suggest(name string) string {
+	if ids == nil {
+		return ""
+	}
+	best, bestDist := "", 3
+	if len(name) < 6 {
+		bestDist = 2
+	}
+	for _, entry := range ids.Entries {
+		if dist := editDistance(strings.ToUpper(name), strings.ToUpper(entry.Name)); dist < bestDist {
+			best, bestDist = entry.Name, dist
+		}
+	}
+	if best == "" {
+		return ""
+	}
+	return fmt.Sprintf(", did you mean %s?", best)
+}
+
+// Appends an entry, the id is written in hex when most existing ids are
+func (ids *IDS) Add(id int, name string) *IdsEntry {
+	hex := 0
+	for _, entry := range ids.Entries {
+		if entry.isHex() {
+			hex++
+		}
+	}
+	entry := IdsEntry{Id: id, Name: name, IdText: strconv.Itoa(id)}
+	if hex*2 > len(ids.Entries) {
+		entry.IdText = fmt.Sprintf("0x%x", id)
+	}
+	ids.Entries = append(ids.Entries, entry)
+	return &ids.Entries[len(ids.Entries)-1]
+}
+
+func (entry *IdsEntry) isHex() bool {
+	return strings.HasPrefix(strings.ToLower(entry.IdText), "0x")
+}
+
+func idToType(t int) string {
+	return map[int]string{IDS_OBJECT: "O", IDS_ACTION: "A", IDS_STRING: "S", IDS_POINT: "P", IDS_INT: "I"}[t]
+}
+
+func (entry *IdsEntry) String() string {
+	id := entry.IdText
+	if v, err := strconv.ParseInt(id, 0, 64); err != nil || int(v) != entry.Id {
+		id = strconv.Itoa(entry.Id)
+		if entry.isHex() {
+			id = fmt.Sprintf("0x%x", entry.Id)
+		}
+	}
+	if entry.Args == nil {
+		return id + " " + entry.Name
+	}
+	args := make([]string, len(entry.Args))
+	for idx, arg := range entry.Args {
+		args[idx] = idToType(arg.Type) + ":" + arg.Name + "*" + arg.Specifics
+	}
+	return id + " " + entry.Name + "(" + strings.Join(args, ",") + ")"
+}
+
+func (ids *IDS) entryLine(entry *IdsEntry) string {
+	if ids.prelude != nil {
+		return entry.IdText + " " + entry.Name
+	}
+	return entry.String()
+}
+
+// Writes the IDS, entries that did not change are written as they were read
+// together with the blank and unparsed lines before them
+func (ids *IDS) Write(w io.Writer) error {
+	newline := ids.newline
+	if newline == "" {
+		newline = "\r\n"
+	}
+	lines := []string{}
+	if ids.Header != "" {
+		lines = append(lines, ids.Header)
+	}
+	if ids.HasCount {
+		count := strconv.Itoa(len(ids.Entries))
+		if strings.TrimSpace(ids.countLine) == count {
+			count = ids.countLine
+		}
+		lines = append(lines, count)
+	}
+	lines = append(lines, ids.prelude...)
+	for idx := range ids.Entries {
+		entry := &ids.Entries[idx]
+		lines = append(lines, entry.before...)
+		if entry.raw != "" && ids.entryLine(entry) == entry.orig {
+			lines = append(lines, entry.raw)
+		} else {
+			lines = append(lines, ids.entryLine(entry))
+		}
+	}
+	lines = append(lines, ids.trailer...)
+	data := []byte(strings.Join(lines, newline) + newline)
+	if ids.Encrypted {
+		data = Encrypt(data)
+	}
+	_, err := w.Write(data)
+	return err
 }
@@ -0,0 +1,133 @@
+package bg
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestIDS(t *testing.T) {
+	src := "IDS V1.0\r\n0x4002 True()\r\n0x400F Global(S:Name*,S:Area*,I:Value*)\r\n0x400F GLOBAL(S:Name*,S:Area*,I:Value*)\r\n"
+	ids, err := OpenIDS(strings.NewReader(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry := ids.ByName("global"); entry == nil || entry.Id != 0x400f || len(entry.Args) != 3 {
+		t.Errorf("Bad lookup by name: %+v", entry)
+	}
+	if entry := ids.ByID(0x400f); entry == nil || entry.Name != "Global" {
+		t.Errorf("Bad lookup by id: %+v", entry)
+	}
+	if len(ids.EntriesByID(0x400f)) != 2 || ids.ByID(1) != nil {
+		t.Errorf("Bad duplicate ids")
+	}
+
+	var buf bytes.Buffer
+	if err = ids.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != src {
+		t.Errorf("IDS did not round trip:\n%q\n%q", buf.String(), src)
+	}
+
+	src = "IDS V1.0\n2\n0x4002\tTrue()\n\n// broken\n0x400F   Global(S:Name*,S:Area*,I:Value*)\n"
+	edited, err := OpenIDS(strings.NewReader(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf.Reset()
+	edited.Write(&buf)
+	if buf.String() != src {
+		t.Errorf("IDS did not round trip:\n%q\n%q", buf.String(), src)
+	}
+	edited.Entries[1].Name = "GlobalX"
+	edited.Add(0x4003, "FALSE")
+	buf.Reset()
+	edited.Write(&buf)
+	expected := "IDS V1.0\n3\n0x4002\tTrue()\n\n// broken\n0x400F GlobalX(S:Name*,S:Area*,I:Value*)\n0x4003 FALSE\n"
+	if buf.String() != expected {
+		t.Errorf("Bad edited IDS:\n%q\n%q", buf.String(), expected)
+	}
+
+	ids.Add(0x4003, "False")
+	kit, _ := OpenIDS(strings.NewReader("IDS V1.0\n0 TRUECLASS\n0x4000 BERSERKER\n16385 WIZARDSLAYER\n"))
+	kit.Add(16386, "KENSAI")
+	if ids.Entries[3].String() != "0x4003 False" || kit.Entries[3].String() != "16386 KENSAI" {
+		t.Errorf("Bad added entries: %s, %s", ids.Entries[3].String(), kit.Entries[3].String())
+	}
+}
+
+func TestOpenIDSStrict(t *testing.T) {
+	tests := []struct {
+		src     string
+		header  string
+		count   bool
+		entries int
+	}{
+		{"IDS V1.0\n2\n0 NONE\n1 ONE\n", "IDS V1.0", true, 2},
+		{"3\n0 NONE\n1 ONE\n", "", true, 2},
+		{"0 NONE\n1\tONE\n", "", false, 2},
+		{"2DA V1.0\n0\n   NAME\n0 NONE\n0x01 ONE\n", "2DA V1.0", false, 2},
+	}
+	for _, test := range tests {
+		ids, err := OpenIDSStrict(strings.NewReader(test.src))
+		if err != nil {
+			t.Fatalf("%q: %v", test.src, err)
+		}
+		if ids.Header != test.header || ids.HasCount != test.count || len(ids.Entries) != test.entries || ids.ByName("one").Id != 1 {
+			t.Errorf("%q: bad IDS %+v", test.src, ids)
+		}
+		var buf bytes.Buffer
+		if err = ids.Write(&buf); err != nil {
+			t.Fatal(err)
+		}
+		if test.count && !strings.Contains("\n"+buf.String(), "\n2\n") {
+			t.Errorf("Count not written: %q", buf.String())
+		}
+	}
+
+	ids, err := OpenIDS(strings.NewReader("IDS V1.0\n0x20 HitBy(O:Object*,I:Style*AStyles)\n1 Bad(X:Y*)\nNAME\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if arg := ids.ByID(0x20).Args[1]; arg.Name != "Style" || arg.Specifics != "AStyles" {
+		t.Errorf("Bad arg: %+v", arg)
+	}
+	if len(ids.Warnings) != 2 || ids.Warnings[0].Line != 3 || ids.Warnings[1].Line != 4 {
+		t.Errorf("Bad warnings: %+v", ids.Warnings)
+	}
+	if _, err = OpenIDSStrict(strings.NewReader("IDS V1.0\n1 Bad(X:Y*)\n")); err == nil {
+		t.Errorf("Expected error for bad argument type")
+	}
+
+	plain := []byte("IDS V1.0\n1 ONE\n")
+	encrypted := []byte{0xff, 0xff}
+	for idx, c := range plain {
+		encrypted = append(encrypted, c^xorKey[idx%len(xorKey)])
+	}
+	if ids, err = OpenIDS(bytes.NewReader(encrypted)); err != nil || !ids.Encrypted || ids.ByName("ONE") == nil {
+		t.Errorf("Bad encrypted IDS: %+v %v", ids, err)
+	}
+}
+
+func TestWriteEncryptedIDS(t *testing.T) {
+	plain := []byte("IDS V1.0\r\n1 ONE\r\n")
+	encrypted := Encrypt(plain)
+	ids, err := OpenIDS(bytes.NewReader(encrypted))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err = ids.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), encrypted) {
+		t.Errorf("Encrypted IDS not written encrypted: %q", buf.Bytes())
+	}
+	ids.Encrypted = false
+	buf.Reset()
+	ids.Write(&buf)
+	if !bytes.Equal(buf.Bytes(), plain) {
+		t.Errorf("Decrypted IDS: %q", buf.Bytes())
+	}
+}
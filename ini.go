@@ -3,8 +3,10 @@ package bg
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"regexp"
 	"strings"
@@ -55,6 +57,13 @@ func (f File) Load(in io.Reader) (err error) {
 	if !ok {
 		bufin = bufio.NewReader(in)
 	}
+	if head, _ := bufin.Peek(2); IsEncrypted(head) {
+		data, err := ioutil.ReadAll(bufin)
+		if err != nil {
+			return err
+		}
+		bufin = bufio.NewReader(bytes.NewReader(Decrypt(data)))
+	}
 	return parseFile(bufin, f)
 }
 
@@ -2,6 +2,7 @@ package bg
 
 import (
 	"encoding/binary"
+	"encoding/json"
 	"fmt"
 	"io"
 	"os"
@@ -46,10 +47,29 @@ type itmHeader struct {
 	EquipedEffectCount    uint16
 }
 
+// Header fields following the V1 header in Planescape: Torment items
+type itmHeaderV11 struct {
+	Dialog           RESREF
+	ConversableLabel uint32
+	PaperdollColor   uint16
+	Unknown          [26]byte
+}
+
+// Header fields following the V1 header in Icewind Dale II items
+type itmHeaderV20 struct {
+	Unknown [16]byte
+}
+
 const (
 	NUM_ATTACK_TYPES = 6
 )
 
+const (
+	ITM_V1 = iota
+	ITM_V11
+	ITM_V20
+)
+
 type itmAbility struct {
 	Type                 uint16
 	QuickSlotType        uint8
@@ -96,27 +116,85 @@ type ItmEffect struct {
 	Special          uint32
 }
 
+// HeaderV11 is only used by V1.1 items and HeaderV20 and AbilityTrailers by
+// V2.0 items, everything else is shared by all versions
 type ITM struct {
-	Header    itmHeader
-	Abilities []itmAbility
-	Effects   []ItmEffect
-	Filename  string
+	Header          itmHeader
+	HeaderV11       itmHeaderV11
+	HeaderV20       itmHeaderV20
+	Abilities       []itmAbility
+	AbilityTrailers [][16]byte
+	Effects         []ItmEffect
+	Filename        string
+}
+
+// Returns ITM_V1, ITM_V11 or ITM_V20, -1 for an unknown version
+func (itm *ITM) Version() int {
+	switch string(itm.Header.Version[:]) {
+	case "V1  ", "V1.0":
+		return ITM_V1
+	case "V1.1":
+		return ITM_V11
+	case "V2.0":
+		return ITM_V20
+	}
+	return -1
+}
+
+// Returns the header following the V1 header, nil if the version has none
+func (itm *ITM) extraHeader() interface{} {
+	switch itm.Version() {
+	case ITM_V11:
+		return &itm.HeaderV11
+	case ITM_V20:
+		return &itm.HeaderV20
+	}
+	return nil
 }
 
+// Writes the item in the layout of its version with the ability and effect
+// offsets computed to match, itm.Header is left as is
 func (itm *ITM) Write(w io.Writer) error {
-	err := binary.Write(w, binary.LittleEndian, itm.Header)
+	version := itm.Version()
+	if version < 0 {
+		return fmt.Errorf("Unsupported ITM version: %q", string(itm.Header.Version[:]))
+	}
+	extra := itm.extraHeader()
+	headerSize := binary.Size(itm.Header)
+	if extra != nil {
+		headerSize += binary.Size(extra)
+	}
+	header := itm.Header
+	header.AbilityCount = uint16(len(itm.Abilities))
+	header.AbilityOffset, header.EffectsOffset = abilityLayout(headerSize, binary.Size(itmAbility{}), len(itm.Abilities), version == ITM_V20)
+
+	err := binary.Write(w, binary.LittleEndian, header)
 	if err != nil {
 		return err
 	}
-	err = binary.Write(w, binary.LittleEndian, itm.Abilities)
+	if extra != nil {
+		err = binary.Write(w, binary.LittleEndian, extra)
+		if err != nil {
+			return err
+		}
+	}
+	err = writeAbilities(w, len(itm.Abilities), func(idx int) error {
+		return binary.Write(w, binary.LittleEndian, itm.Abilities[idx])
+	}, itm.AbilityTrailers, version == ITM_V20)
 	if err != nil {
 		return err
 	}
-	err = binary.Write(w, binary.LittleEndian, itm.Effects)
+	return binary.Write(w, binary.LittleEndian, itm.Effects)
+}
+
+func (itm *ITM) WriteJson(w io.Writer) error {
+	bytes, err := json.MarshalIndent(itm, "", "\t")
 	if err != nil {
 		return err
 	}
-	return nil
+
+	_, err = w.Write(bytes)
+	return err
 }
 
 func (itm *ITM) Tp2Block(baseNum int) (string, []int) {
@@ -180,13 +258,24 @@ func OpenITM(r io.ReadSeeker) (*ITM, error) {
 	if err != nil {
 		return nil, err
 	}
+	if itm.Version() < 0 {
+		return nil, fmt.Errorf("Unsupported ITM version: %q", string(itm.Header.Version[:]))
+	}
+	if extra := itm.extraHeader(); extra != nil {
+		err = binary.Read(r, binary.LittleEndian, extra)
+		if err != nil {
+			return nil, err
+		}
+	}
 
-	itm.Abilities = make([]itmAbility, itm.Header.AbilityCount)
 	_, err = r.Seek(int64(itm.Header.AbilityOffset), os.SEEK_SET)
 	if err != nil {
 		return nil, err
 	}
-	err = binary.Read(r, binary.LittleEndian, &itm.Abilities)
+	itm.Abilities = make([]itmAbility, itm.Header.AbilityCount)
+	itm.AbilityTrailers, err = readAbilities(r, len(itm.Abilities), func(idx int) error {
+		return binary.Read(r, binary.LittleEndian, &itm.Abilities[idx])
+	}, itm.Version() == ITM_V20)
 	if err != nil {
 		return nil, err
 	}
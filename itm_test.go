@@ -0,0 +1,72 @@
+package bg
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestItmVersions(t *testing.T) {
+	for _, version := range []string{"V1  ", "V1.1", "V2.0"} {
+		itm := &ITM{
+			Abilities: []itmAbility{{Type: 1, EffectCount: 1}, {Type: 2, EffectCount: 0}},
+			Effects:   []ItmEffect{{EffectID: 12}, {EffectID: 13}},
+		}
+		itm.Header.EquipedEffectCount = 1
+		copy(itm.Header.Signature[:], "ITM ")
+		copy(itm.Header.Version[:], version)
+		switch itm.Version() {
+		case ITM_V11:
+			itm.HeaderV11.Dialog = NewResref("DMORTE")
+			itm.HeaderV11.ConversableLabel = 42
+			itm.HeaderV11.PaperdollColor = 7
+			itm.HeaderV11.Unknown[25] = 8
+		case ITM_V20:
+			itm.HeaderV20.Unknown[0] = 9
+			itm.AbilityTrailers = [][16]byte{{1}, {2}}
+		}
+
+		var buf bytes.Buffer
+		if err := itm.Write(&buf); err != nil {
+			t.Fatal(err)
+		}
+		sizes := map[string]int{"V1  ": 0x72, "V1.1": 0x9a, "V2.0": 0x82}
+		abilitySize := 0x38
+		if version == "V2.0" {
+			abilitySize = 0x48
+		}
+		if itm.Header.AbilityOffset != 0 || itm.Header.AbilityCount != 0 {
+			t.Errorf("%s: Write changed the header: %+v", version, itm.Header)
+		}
+		out, err := OpenITM(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if buf.Len() != sizes[version]+2*abilitySize+2*0x30 || int(out.Header.AbilityOffset) != sizes[version] {
+			t.Errorf("%s: bad layout, %d bytes with abilities at 0x%x", version, buf.Len(), out.Header.AbilityOffset)
+		}
+		itm.Header.AbilityCount, itm.Header.AbilityOffset, itm.Header.EffectsOffset = 2, out.Header.AbilityOffset, out.Header.EffectsOffset
+		if !reflect.DeepEqual(itm, out) {
+			t.Errorf("%s did not round trip\n%+v\n%+v", version, itm, out)
+		}
+
+		buf.Reset()
+		if err = out.WriteJson(&buf); err != nil {
+			t.Fatal(err)
+		}
+		fromJson := &ITM{}
+		if err = json.Unmarshal(buf.Bytes(), fromJson); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(out, fromJson) {
+			t.Errorf("%s did not round trip through JSON\n%+v\n%+v", version, out, fromJson)
+		}
+	}
+
+	bad := &ITM{}
+	copy(bad.Header.Version[:], "V9.9")
+	if err := bad.Write(&bytes.Buffer{}); err == nil {
+		t.Errorf("Expected error for unknown version")
+	}
+}
@@ -0,0 +1,58 @@
+package bg
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// Items and spells are laid out the same way: the V1 header, the header of
+// the version if any, the abilities, each followed by 16 more bytes in V2.0
+// files, and the effects.
+
+// Returns the ability and effect offsets of count abilities of abilitySize
+// bytes following headerSize bytes of headers
+func abilityLayout(headerSize int, abilitySize int, count int, trailers bool) (uint32, uint32) {
+	if trailers {
+		abilitySize += 16
+	}
+	return uint32(headerSize), uint32(headerSize + count*abilitySize)
+}
+
+// Writes count abilities through writeAbility, each followed by its trailer
+// when withTrailers is set.  Missing trailers are written as zeros.
+func writeAbilities(w io.Writer, count int, writeAbility func(idx int) error, trailers [][16]byte, withTrailers bool) error {
+	for idx := 0; idx < count; idx++ {
+		if err := writeAbility(idx); err != nil {
+			return err
+		}
+		if withTrailers {
+			var trailer [16]byte
+			if idx < len(trailers) {
+				trailer = trailers[idx]
+			}
+			if err := binary.Write(w, binary.LittleEndian, trailer); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Reads count abilities through readAbility, returning the 16 bytes that
+// follow each when withTrailers is set
+func readAbilities(r io.Reader, count int, readAbility func(idx int) error, withTrailers bool) ([][16]byte, error) {
+	var trailers [][16]byte
+	for idx := 0; idx < count; idx++ {
+		if err := readAbility(idx); err != nil {
+			return nil, err
+		}
+		if withTrailers {
+			var trailer [16]byte
+			if err := binary.Read(r, binary.LittleEndian, &trailer); err != nil {
+				return nil, err
+			}
+			trailers = append(trailers, trailer)
+		}
+	}
+	return trailers, nil
+}
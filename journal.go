@@ -0,0 +1,94 @@
+package bg
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	QUEST_NONE = iota
+	QUEST_UNSOLVED
+	QUEST_SOLVED
+	QUEST_NOTE
+)
+
+// A JournalEntry is a journal STRREF granted by a dialog transition, State and
+// Transition are numbered as in WeiDU D (the transition index is relative to
+// the state).
+type JournalEntry struct {
+	Strref     uint32
+	Text       string
+	QuestState int
+	Dialog     string
+	State      int
+	Transition int
+}
+
+// Returns the journal section the entry of the transition is added to,
+// QUEST_NOTE is a plain note without quest
+func (trans *DlgTransition) QuestState() int {
+	switch {
+	case trans.AddCompleteQuest():
+		return QUEST_SOLVED
+	case trans.AddQuest():
+		return QUEST_UNSOLVED
+	case trans.Flags&DLG_TRANS_NOTE != 0:
+		return QUEST_NOTE
+	}
+	return QUEST_NONE
+}
+
+// Returns every journal entry granted by the transitions of the dialog, tlk
+// is optional
+func (dlg *DLG) JournalEntries(name string, tlk *TLK) []JournalEntry {
+	entries := []JournalEntry{}
+	name = strings.ToUpper(name)
+	for sIdx, state := range dlg.States {
+		for tIdx, trans := range dlg.stateTransitions(state) {
+			if !trans.HasJournal() {
+				continue
+			}
+			entry := JournalEntry{Strref: trans.JournalText, QuestState: trans.QuestState(), Dialog: name, State: sIdx, Transition: tIdx}
+			if tlk != nil {
+				entry.Text = fetch(tlk, trans.JournalText)
+			}
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// Collects the journal entries of every dialog in key ordered by STRREF.
+// Dialogs that cannot be read are skipped and returned as errors.
+func JournalReport(key *KEY, tlk *TLK) ([]JournalEntry, []error) {
+	return journalReport(key.GetFilesByType(fileTypes["dlg"]), key.OpenFile, tlk)
+}
+
+func journalReport(files []string, open func(name string) ([]byte, error), tlk *TLK) ([]JournalEntry, []error) {
+	entries := []JournalEntry{}
+	errs := []error{}
+	for _, file := range files {
+		data, err := open(file)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", file, err))
+			continue
+		}
+		dlg, err := OpenDlg(bytes.NewReader(data))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", file, err))
+			continue
+		}
+		name := strings.TrimSuffix(file, filepath.Ext(file))
+		entries = append(entries, dlg.JournalEntries(name, tlk)...)
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].Strref != entries[j].Strref {
+			return entries[i].Strref < entries[j].Strref
+		}
+		return entries[i].Dialog < entries[j].Dialog
+	})
+	return entries, errs
+}
@@ -0,0 +1,57 @@
+package bg
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestJournalReport(t *testing.T) {
+	dlg := newTestDlg()
+	dlg.Transitions[0].Flags |= DLG_TRANS_JOURNAL | DLG_TRANS_SOLVED
+	dlg.Transitions[0].JournalText = 2
+	dlg.Transitions[2].Flags |= DLG_TRANS_JOURNAL | DLG_TRANS_NOTE
+	dlg.Transitions[2].JournalText = 1
+	other := newTestDlg()
+	other.Transitions[1].Flags |= DLG_TRANS_JOURNAL | DLG_TRANS_UNSOLVED
+	other.Transitions[1].JournalText = 1
+
+	files := map[string][]byte{"broken.dlg": []byte("DLG V1.0")}
+	for name, d := range map[string]*DLG{"first.dlg": dlg, "other.dlg": other} {
+		var buf bytes.Buffer
+		if err := d.Write(&buf); err != nil {
+			t.Fatal(err)
+		}
+		files[name] = buf.Bytes()
+	}
+	open := func(name string) ([]byte, error) {
+		if data, ok := files[name]; ok {
+			return data, nil
+		}
+		return nil, fmt.Errorf("not found")
+	}
+
+	tlk := newTestTlk("zero", "one", "two")
+	entries, errs := journalReport([]string{"first.dlg", "broken.dlg", "missing.dlg", "other.dlg"}, open, tlk)
+	if len(errs) != 2 {
+		t.Errorf("Expected errors for the broken and missing dialogs: %v", errs)
+	}
+	expected := []JournalEntry{
+		{Strref: 1, Text: "one", QuestState: QUEST_NOTE, Dialog: "FIRST", State: 1, Transition: 0},
+		{Strref: 1, Text: "one", QuestState: QUEST_UNSOLVED, Dialog: "OTHER", State: 0, Transition: 1},
+		{Strref: 2, Text: "two", QuestState: QUEST_SOLVED, Dialog: "FIRST", State: 0, Transition: 0},
+	}
+	if len(entries) != len(expected) {
+		t.Fatalf("Unexpected entries: %+v", entries)
+	}
+	for idx := range expected {
+		if entries[idx] != expected[idx] {
+			t.Errorf("Entry %d: %+v != %+v", idx, entries[idx], expected[idx])
+		}
+	}
+
+	trans := DlgTransition{Flags: DLG_TRANS_JOURNAL}
+	if trans.QuestState() != QUEST_NONE {
+		t.Errorf("Plain journal entry has quest state %d", trans.QuestState())
+	}
+}
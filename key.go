@@ -271,6 +271,19 @@ func (key *KEY) Explode(dir string) error {
 	return nil
 }
 
+// Reports whether name is in the key or the override directory
+func (key *KEY) HasFile(name string) bool {
+	resName := strings.ToUpper(strings.Split(name, ".")[0])
+	resType := key.ExtToType(strings.ToLower(filepath.Ext(name)))
+	if key.files[keyUniqueResource{Name: resName, Type: uint16(resType)}] != nil {
+		return true
+	}
+	_, err := os.Stat(filepath.Join(key.root, "override", name))
+	return err == nil
+}
+
+// Returns the contents of the file as stored, the parsers of text resources
+// remove any encryption themselves
 func (key *KEY) OpenFile(name string) ([]byte, error) {
 	resName := strings.ToUpper(strings.Split(name, ".")[0])
 	resType := key.ExtToType(filepath.Ext(name))
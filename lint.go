@@ -0,0 +1,205 @@
+package bg
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const (
+	LINT_ERROR = iota
+	LINT_WARNING
+)
+
+var lintSeverities = []string{"error", "warning"}
+
+// A LintIssue is a problem found in a script, Source names the script and
+// the block or dialog string, Line and Column are relative to it
+type LintIssue struct {
+	Severity int
+	Source   string
+	Line     int
+	Column   int
+	Msg      string
+}
+
+func (issue LintIssue) String() string {
+	return fmt.Sprintf("%s:%d:%d: %s: %s", issue.Source, issue.Line, issue.Column, lintSeverities[issue.Severity], issue.Msg)
+}
+
+// Resource types of string arguments by IDS argument name, an empty type
+// only has its length checked
+var lintResrefArgs = map[string]string{
+	"resref":     "",
+	"area":       "are",
+	"item":       "itm",
+	"dialogfile": "dlg",
+	"dialog":     "dlg",
+	"newobject":  "cre",
+	"creature":   "cre",
+	"script":     "bcs",
+	"scriptfile": "bcs",
+	"sound":      "wav",
+	"store":      "sto",
+}
+
+// Key is optional, without it resources are not checked for existence
+type Linter struct {
+	IDS *ScriptIDS
+	Key *KEY
+}
+
+func NewLinter(ids *ScriptIDS, key *KEY) *Linter {
+	return &Linter{IDS: ids, Key: key}
+}
+
+func lintError(source string, err error) LintIssue {
+	issue := LintIssue{Severity: LINT_ERROR, Source: source, Msg: err.Error()}
+	if scriptErr, ok := err.(ScriptError); ok {
+		issue.Line, issue.Column, issue.Msg = scriptErr.Line, scriptErr.Column, scriptErr.Msg
+	}
+	return issue
+}
+
+func (l *Linter) resrefs(source string, call *ScriptCall, entry *IdsEntry) []LintIssue {
+	issues := []LintIssue{}
+	for idx, arg := range call.Args {
+		if idx >= len(entry.Args) || arg.Kind != SCRIPT_ARG_STRING {
+			continue
+		}
+		expected := entry.Args[idx]
+		ext, ok := lintResrefArgs[strings.ToLower(expected.Name)]
+		if !ok || (idx > 0 && strings.EqualFold(expected.Name, "Area") && entry.Args[idx-1].Type == IDS_STRING) {
+			continue
+		}
+		issue := LintIssue{Severity: LINT_ERROR, Source: source, Line: arg.Line, Column: arg.Column}
+		if len(arg.Str) > 8 {
+			issue.Msg = fmt.Sprintf("%s %q is longer than 8 characters", expected.Name, arg.Str)
+			issues = append(issues, issue)
+		} else if l.Key != nil && ext != "" && arg.Str != "" && !l.Key.HasFile(arg.Str+"."+ext) {
+			issue.Severity = LINT_WARNING
+			issue.Msg = fmt.Sprintf("%s %s.%s not found", expected.Name, strings.ToUpper(arg.Str), strings.ToUpper(ext))
+			issues = append(issues, issue)
+		}
+	}
+	return issues
+}
+
+func (l *Linter) lintCall(source string, call *ScriptCall, action bool) []LintIssue {
+	var err error
+	var entry *IdsEntry
+	if action {
+		_, err = l.IDS.compileAction(call)
+		entry = l.IDS.Action.ByName(call.Name)
+	} else {
+		_, err = l.IDS.compileTrigger(call)
+		entry = l.IDS.Trigger.ByName(call.Name)
+	}
+	if err != nil {
+		return []LintIssue{lintError(source, err)}
+	}
+	if action && call.Name == "ActionOverride" {
+		return l.lintCall(source, call.Args[1].Call, true)
+	}
+	return l.resrefs(source, call, entry)
+}
+
+func isTrueBlock(block bafBlock) bool {
+	for _, call := range block.Triggers {
+		if call.Negated || !strings.EqualFold(call.Name, "True") {
+			return false
+		}
+	}
+	return true
+}
+
+func (l *Linter) lintBlock(source string, block bafBlock, last bool) []LintIssue {
+	issues := []LintIssue{}
+	for _, call := range block.Triggers {
+		issues = append(issues, l.lintCall(source, call, false)...)
+	}
+	continues := false
+	for _, resp := range block.Responses {
+		for idx, call := range resp.Actions {
+			issues = append(issues, l.lintCall(source, call, true)...)
+			if strings.EqualFold(call.Name, "Continue") {
+				if idx != len(resp.Actions)-1 {
+					issues = append(issues, LintIssue{Severity: LINT_WARNING, Source: source, Line: call.Line, Column: call.Column,
+						Msg: "Continue() should be the last action of the response"})
+				}
+				continues = true
+			}
+		}
+	}
+	if !last && !continues && isTrueBlock(block) {
+		issues = append(issues, LintIssue{Severity: LINT_WARNING, Source: source, Line: block.Line, Column: 1,
+			Msg: "block is always true and has no Continue(), the blocks after it never run"})
+	}
+	return issues
+}
+
+func (l *Linter) LintBaf(name string, r io.Reader) []LintIssue {
+	blocks, err := parseBaf(r)
+	if err != nil {
+		return []LintIssue{lintError(name, err)}
+	}
+	issues := []LintIssue{}
+	for idx, block := range blocks {
+		issues = append(issues, l.lintBlock(name, block, idx == len(blocks)-1)...)
+	}
+	return issues
+}
+
+// Lints a compiled script block by block, lines are those of the decompiled
+// block
+func (l *Linter) LintBcs(name string, bcs *BCS) []LintIssue {
+	issues := []LintIssue{}
+	for idx, block := range bcs.Blocks {
+		source := fmt.Sprintf("%s block %d", name, idx)
+		var buf bytes.Buffer
+		single := BCS{Blocks: []BcsBlock{block}}
+		if err := single.WriteBaf(&buf, l.IDS); err != nil {
+			issues = append(issues, lintError(source, err))
+			continue
+		}
+		blocks, err := parseBaf(&buf)
+		if err != nil {
+			issues = append(issues, lintError(source, err))
+			continue
+		}
+		issues = append(issues, l.lintBlock(source, blocks[0], idx == len(bcs.Blocks)-1)...)
+	}
+	return issues
+}
+
+func (l *Linter) lintDlgString(source string, str string, action bool) []LintIssue {
+	parse := ParseTriggers
+	if action {
+		parse = ParseActions
+	}
+	calls, err := parse(str)
+	if err != nil {
+		return []LintIssue{lintError(source, err)}
+	}
+	issues := []LintIssue{}
+	for _, call := range calls {
+		issues = append(issues, l.lintCall(source, call, action)...)
+	}
+	return issues
+}
+
+// Lints the trigger and action strings of the dialog
+func (l *Linter) LintDlg(name string, dlg *DLG) []LintIssue {
+	issues := []LintIssue{}
+	for idx, str := range dlg.StateTriggers {
+		issues = append(issues, l.lintDlgString(fmt.Sprintf("%s state trigger %d", name, idx), str, false)...)
+	}
+	for idx, str := range dlg.TransitionTriggers {
+		issues = append(issues, l.lintDlgString(fmt.Sprintf("%s transition trigger %d", name, idx), str, false)...)
+	}
+	for idx, str := range dlg.Actions {
+		issues = append(issues, l.lintDlgString(fmt.Sprintf("%s action %d", name, idx), str, true)...)
+	}
+	return issues
+}
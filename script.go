@@ -0,0 +1,102 @@
+package bg
+
+import (
+	"strconv"
+	"strings"
+)
+
+func parseScriptCalls(src string) ([]*ScriptCall, error) {
+	tokens, err := bafTokenize(src, 1)
+	if err != nil {
+		return nil, err
+	}
+	p := &bafParser{tokens: tokens}
+	calls := []*ScriptCall{}
+	for p.peek().Kind != bafTokEOF {
+		call, err := p.call()
+		if err != nil {
+			return nil, err
+		}
+		calls = append(calls, call)
+	}
+	return calls, nil
+}
+
+// Parses a trigger string as stored in a DLG, such as
+// Global("X","GLOBAL",1) !InParty(Myself)
+func ParseTriggers(src string) ([]*ScriptCall, error) {
+	return parseScriptCalls(src)
+}
+
+// Parses an action string as stored in a DLG
+func ParseActions(src string) ([]*ScriptCall, error) {
+	calls, err := parseScriptCalls(src)
+	if err != nil {
+		return nil, err
+	}
+	for _, call := range calls {
+		if call.Negated {
+			return nil, ScriptError{Line: call.Line, Column: call.Column, Msg: "actions cannot be negated"}
+		}
+	}
+	return calls, nil
+}
+
+// Checks the triggers against trigger.ids, names are changed to the case used
+// by the IDS file and the argument types are filled in
+func (ids *ScriptIDS) ValidateTriggers(calls []*ScriptCall) []error {
+	errs := []error{}
+	for _, call := range calls {
+		if _, err := ids.compileTrigger(call); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// Checks the actions against action.ids, names are changed to the case used
+// by the IDS file and the argument types are filled in
+func (ids *ScriptIDS) ValidateActions(calls []*ScriptCall) []error {
+	errs := []error{}
+	for _, call := range calls {
+		if _, err := ids.compileAction(call); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+func (arg *ScriptArg) String() string {
+	switch arg.Kind {
+	case SCRIPT_ARG_INT:
+		return strconv.Itoa(arg.Int)
+	case SCRIPT_ARG_STRING:
+		return bafString(arg.Str)
+	case SCRIPT_ARG_LIST:
+		return "[" + strings.Join(arg.Fields, ".") + "]"
+	case SCRIPT_ARG_CALL:
+		return arg.Call.String()
+	}
+	return arg.Str
+}
+
+func (call *ScriptCall) String() string {
+	args := make([]string, len(call.Args))
+	for idx := range call.Args {
+		args[idx] = call.Args[idx].String()
+	}
+	out := call.Name + "(" + strings.Join(args, ",") + ")"
+	if call.Negated {
+		out = "!" + out
+	}
+	return out
+}
+
+// Prints the calls one per line in canonical form
+func FormatScript(calls []*ScriptCall) string {
+	lines := make([]string, len(calls))
+	for idx, call := range calls {
+		lines[idx] = call.String()
+	}
+	return strings.Join(lines, "\n")
+}
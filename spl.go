@@ -2,6 +2,8 @@ package bg
 
 import (
 	"encoding/binary"
+	"encoding/json"
+	"fmt"
 	"io"
 	"os"
 )
@@ -47,6 +49,16 @@ type splHeader struct {
 	CastingEffectCount    uint16
 }
 
+// Header fields following the V1 header in Icewind Dale II spells
+type splHeaderV20 struct {
+	Unknown [16]byte
+}
+
+const (
+	SPL_V1 = iota
+	SPL_V20
+)
+
 type splAbility struct {
 	Type            uint16
 	QuickSlotType   uint16
@@ -68,27 +80,79 @@ type splAbility struct {
 	MissileType     uint16
 }
 
+// HeaderV20 and AbilityTrailers are only used by V2.0 spells, everything else
+// is shared by all versions
 type SPL struct {
-	Header    splHeader
-	Abilities []splAbility
-	Effects   []ItmEffect
-	Filename  string
+	Header          splHeader
+	HeaderV20       splHeaderV20
+	Abilities       []splAbility
+	AbilityTrailers [][16]byte
+	Effects         []ItmEffect
+	Filename        string
+}
+
+// Returns SPL_V1 or SPL_V20, -1 for an unknown version
+func (spl *SPL) Version() int {
+	switch string(spl.Header.Version[:]) {
+	case "V1  ", "V1.0":
+		return SPL_V1
+	case "V2.0":
+		return SPL_V20
+	}
+	return -1
+}
+
+// Returns the header following the V1 header, nil if the version has none
+func (spl *SPL) extraHeader() interface{} {
+	if spl.Version() == SPL_V20 {
+		return &spl.HeaderV20
+	}
+	return nil
 }
 
+// Writes the spell in the layout of its version with the ability and effect
+// offsets computed to match, spl.Header is left as is
 func (spl *SPL) Write(w io.Writer) error {
-	err := binary.Write(w, binary.LittleEndian, spl.Header)
+	version := spl.Version()
+	if version < 0 {
+		return fmt.Errorf("Unsupported SPL version: %q", string(spl.Header.Version[:]))
+	}
+	extra := spl.extraHeader()
+	headerSize := binary.Size(spl.Header)
+	if extra != nil {
+		headerSize += binary.Size(extra)
+	}
+	header := spl.Header
+	header.AbilityCount = uint16(len(spl.Abilities))
+	header.AbilityOffset, header.EffectsOffset = abilityLayout(headerSize, binary.Size(splAbility{}), len(spl.Abilities), version == SPL_V20)
+
+	err := binary.Write(w, binary.LittleEndian, header)
 	if err != nil {
 		return err
 	}
-	err = binary.Write(w, binary.LittleEndian, spl.Abilities)
+	if extra != nil {
+		err = binary.Write(w, binary.LittleEndian, extra)
+		if err != nil {
+			return err
+		}
+	}
+	err = writeAbilities(w, len(spl.Abilities), func(idx int) error {
+		return binary.Write(w, binary.LittleEndian, spl.Abilities[idx])
+	}, spl.AbilityTrailers, version == SPL_V20)
 	if err != nil {
 		return err
 	}
-	err = binary.Write(w, binary.LittleEndian, spl.Effects)
+	return binary.Write(w, binary.LittleEndian, spl.Effects)
+}
+
+func (spl *SPL) WriteJson(w io.Writer) error {
+	bytes, err := json.MarshalIndent(spl, "", "\t")
 	if err != nil {
 		return err
 	}
-	return nil
+
+	_, err = w.Write(bytes)
+	return err
 }
 
 func OpenSPL(r io.ReadSeeker) (*SPL, error) {
@@ -98,13 +162,24 @@ func OpenSPL(r io.ReadSeeker) (*SPL, error) {
 	if err != nil {
 		return nil, err
 	}
+	if spl.Version() < 0 {
+		return nil, fmt.Errorf("Unsupported SPL version: %q", string(spl.Header.Version[:]))
+	}
+	if extra := spl.extraHeader(); extra != nil {
+		err = binary.Read(r, binary.LittleEndian, extra)
+		if err != nil {
+			return nil, err
+		}
+	}
 
-	spl.Abilities = make([]splAbility, spl.Header.AbilityCount)
 	_, err = r.Seek(int64(spl.Header.AbilityOffset), os.SEEK_SET)
 	if err != nil {
 		return nil, err
 	}
-	err = binary.Read(r, binary.LittleEndian, &spl.Abilities)
+	spl.Abilities = make([]splAbility, spl.Header.AbilityCount)
+	spl.AbilityTrailers, err = readAbilities(r, len(spl.Abilities), func(idx int) error {
+		return binary.Read(r, binary.LittleEndian, &spl.Abilities[idx])
+	}, spl.Version() == SPL_V20)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,73 @@
+package bg
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestSplV20(t *testing.T) {
+	spl := &SPL{
+		Abilities:       []splAbility{{Type: 1, EffectCount: 1}, {Type: 2}},
+		AbilityTrailers: [][16]byte{{3}},
+		Effects:         []ItmEffect{{EffectID: 12}},
+	}
+	copy(spl.Header.Signature[:], "SPL ")
+	copy(spl.Header.Version[:], "V2.0")
+	spl.HeaderV20.Unknown[0] = 9
+
+	var buf bytes.Buffer
+	if err := spl.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	if spl.Header.AbilityOffset != 0 || spl.Header.EffectsOffset != 0 {
+		t.Errorf("Write changed the header: %+v", spl.Header)
+	}
+	if data[0x72] != 9 || data[0x82+0x28] != 3 || data[0x82+0x38] != 2 {
+		t.Errorf("Version header, trailer or second ability not where expected")
+	}
+
+	out, err := OpenSPL(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.Header.AbilityOffset != 0x82 || out.Header.EffectsOffset != 0x82+2*0x38 || len(data) != 0x82+2*0x38+0x30 {
+		t.Fatalf("Bad layout, %d bytes with abilities at 0x%x and effects at 0x%x", len(data), out.Header.AbilityOffset, out.Header.EffectsOffset)
+	}
+	// The missing trailer of the second ability is written as zeros
+	spl.AbilityTrailers = append(spl.AbilityTrailers, [16]byte{})
+	spl.Header.AbilityCount, spl.Header.AbilityOffset, spl.Header.EffectsOffset = 2, 0x82, 0x82+2*0x38
+	if !reflect.DeepEqual(spl, out) {
+		t.Errorf("Did not round trip\n%+v\n%+v", spl, out)
+	}
+
+	buf.Reset()
+	if err = out.WriteJson(&buf); err != nil {
+		t.Fatal(err)
+	}
+	fromJson := &SPL{}
+	if err = json.Unmarshal(buf.Bytes(), fromJson); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(out, fromJson) {
+		t.Errorf("Did not round trip through JSON\n%+v\n%+v", out, fromJson)
+	}
+
+	copy(spl.Header.Version[:], "V1  ")
+	buf.Reset()
+	if err := spl.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != 0x72+2*0x28+0x30 {
+		t.Errorf("V1 spell is %d bytes", buf.Len())
+	}
+	out, err = OpenSPL(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.AbilityTrailers != nil || !reflect.DeepEqual(spl.Abilities, out.Abilities) {
+		t.Errorf("V1 spell did not round trip\n%+v", out)
+	}
+}
@@ -0,0 +1,116 @@
+package bg
+
+import (
+	"io"
+)
+
+const (
+	GENDER_MALE = iota
+	GENDER_FEMALE
+)
+
+// A TalkTable pairs dialog.tlk with the optional dialogF.tlk used for
+// female protagonists.
+type TalkTable struct {
+	Male   *TLK
+	Female *TLK
+}
+
+func NewTalkTable(male *TLK, female *TLK) *TalkTable {
+	return &TalkTable{Male: male, Female: female}
+}
+
+// Opens a talk table, female may be nil when the game has no dialogF.tlk
+func OpenTalkTable(male io.ReadSeeker, female io.ReadSeeker) (*TalkTable, error) {
+	tt := &TalkTable{}
+	var err error
+	tt.Male, err = OpenTlk(male)
+	if err != nil {
+		return nil, err
+	}
+	if female != nil {
+		tt.Female, err = OpenTlk(female)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return tt, nil
+}
+
+func (tt *TalkTable) GetStringCount() int {
+	count := tt.Male.GetStringCount()
+	if tt.Female != nil && tt.Female.GetStringCount() > count {
+		count = tt.Female.GetStringCount()
+	}
+	return count
+}
+
+// Resolves stringId for gender, female lookups fall back to the male table
+// when the female entry is missing or empty.
+func (tt *TalkTable) String(stringId int, gender int) (string, error) {
+	if gender == GENDER_FEMALE && tt.Female != nil && stringId < tt.Female.GetStringCount() {
+		str, err := tt.Female.String(stringId)
+		if err != nil {
+			return "", err
+		}
+		if str != "" {
+			return str, nil
+		}
+	}
+	return tt.Male.String(stringId)
+}
+
+func (tt *TalkTable) Entry(stringId int, gender int) (*tlkEntry, error) {
+	if gender == GENDER_FEMALE && tt.Female != nil && stringId < tt.Female.GetStringCount() {
+		str, err := tt.Female.String(stringId)
+		if err != nil {
+			return nil, err
+		}
+		if str != "" {
+			return tt.Female.Entry(stringId)
+		}
+	}
+	return tt.Male.Entry(stringId)
+}
+
+// Adds a string to both tables.  An empty female string leaves the female
+// entry empty so lookups fall back to the male text.
+func (tt *TalkTable) AddString(stringId int, male string, female string, sound string) {
+	tt.Male.AddString(stringId, male, sound)
+	if tt.Female != nil {
+		if female == "" {
+			sound = ""
+		}
+		tt.Female.AddString(stringId, female, sound)
+	}
+	tt.align()
+}
+
+// Pads the shorter table so both hold the same number of strings
+func (tt *TalkTable) align() {
+	if tt.Female == nil {
+		return
+	}
+	count := tt.GetStringCount()
+	if count > 0 {
+		tt.Male.expandEntries(count - 1)
+		tt.Female.expandEntries(count - 1)
+	}
+}
+
+// Writes both tables aligned to the same string count, female is ignored
+// when the talk table has no female TLK.
+func (tt *TalkTable) Write(male io.WriteSeeker, female io.WriteSeeker) error {
+	tt.align()
+	err := tt.Male.Write(male)
+	if err != nil {
+		return err
+	}
+	if tt.Female != nil && female != nil {
+		err = tt.Female.Write(female)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
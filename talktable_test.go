@@ -0,0 +1,76 @@
+package bg
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestTalkTable(t *testing.T) {
+	tt := NewTalkTable(newTestTlk("zero", "one"), newTestTlk("", "une"))
+	tests := []struct {
+		strref   int
+		gender   int
+		expected string
+	}{
+		{0, GENDER_FEMALE, "zero"},
+		{1, GENDER_FEMALE, "une"},
+		{1, GENDER_MALE, "one"},
+	}
+	for _, test := range tests {
+		if str, err := tt.String(test.strref, test.gender); err != nil || str != test.expected {
+			t.Errorf("String %d/%d: %q != %q (%v)", test.strref, test.gender, str, test.expected, err)
+		}
+	}
+	if entry, _ := tt.Entry(0, GENDER_FEMALE); entry != &tt.Male.entries[0] {
+		t.Errorf("Empty female entry did not fall back to the male one")
+	}
+	if entry, _ := tt.Entry(1, GENDER_FEMALE); entry != &tt.Female.entries[1] {
+		t.Errorf("Female entry not used")
+	}
+
+	tt.AddString(3, "three", "", "")
+	tt.AddString(4, "he", "she", "")
+	if tt.Male.GetStringCount() != 5 || tt.Female.GetStringCount() != 5 {
+		t.Errorf("Tables not aligned: %d/%d", tt.Male.GetStringCount(), tt.Female.GetStringCount())
+	}
+	if str, _ := tt.Female.String(3); str != "" {
+		t.Errorf("Female string 3 should be empty: %q", str)
+	}
+
+	files := [2]*os.File{}
+	for idx := range files {
+		f, err := ioutil.TempFile("", "tlk")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(f.Name())
+		defer f.Close()
+		files[idx] = f
+	}
+	tt.Male.AddString(6, "six", "")
+	if err := tt.Write(files[0], files[1]); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		f.Seek(0, os.SEEK_SET)
+	}
+	out, err := OpenTalkTable(files[0], files[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.Male.GetStringCount() != 7 || out.Female.GetStringCount() != 7 {
+		t.Errorf("Written tables not aligned: %d/%d", out.Male.GetStringCount(), out.Female.GetStringCount())
+	}
+	for idx, expected := range []string{"zero", "une", "", "three", "she", "", "six"} {
+		if str, _ := out.String(idx, GENDER_FEMALE); str != expected {
+			t.Errorf("Written string %d: %q != %q", idx, str, expected)
+		}
+	}
+
+	tt = NewTalkTable(newTestTlk("zero"), nil)
+	tt.AddString(1, "one", "une", "")
+	if str, _ := tt.String(1, GENDER_FEMALE); str != "one" {
+		t.Errorf("Male only table: %q", str)
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"os"
 )
 
@@ -36,6 +37,13 @@ type TLK struct {
 	stringBuf []byte
 	r         io.ReadSeeker
 	codepage  string
+	compact   bool
+
+	// Lazy TLKs read on disk strings through ra, strings added afterwards
+	// live in stringBuf at offsets starting from lazySize
+	ra         io.ReaderAt
+	lazyOffset int64
+	lazySize   int64
 }
 
 type TlkJson struct {
@@ -53,6 +61,11 @@ func (t *TLK) SetCodepage(codepage string) {
 	t.codepage = codepage
 }
 
+// When set, Write compacts the string data before writing it
+func (t *TLK) SetCompactOnWrite(compact bool) {
+	t.compact = compact
+}
+
 func (t *TLK) expandEntries(stringId int) {
 	if len(t.entries) <= stringId {
 		for {
@@ -62,6 +75,7 @@ func (t *TLK) expandEntries(stringId int) {
 				break
 			}
 		}
+		t.header.StringOffset = uint32(binary.Size(t.header) + binary.Size(t.entries))
 	}
 }
 
@@ -78,7 +92,28 @@ func (t *TLK) String(stringId int) (string, error) {
 	}
 
 	entry := t.entries[stringId]
-	encodedString := string(t.stringBuf[entry.Offset : entry.Offset+entry.Length])
+	start := int64(entry.Offset)
+	end := start + int64(entry.Length)
+	if t.ra != nil && start < t.lazySize {
+		if end > t.lazySize {
+			return "", fmt.Errorf("String %d overruns string data: %d > %d", stringId, end, t.lazySize)
+		}
+		buf := make([]byte, entry.Length)
+		n, err := t.ra.ReadAt(buf, t.lazyOffset+start)
+		if n < len(buf) {
+			if err == nil || err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return "", err
+		}
+		return string(buf), nil
+	}
+	start -= t.lazySize
+	end -= t.lazySize
+	if start < 0 || end > int64(len(t.stringBuf)) {
+		return "", fmt.Errorf("String %d overruns string data: %d > %d", stringId, end, len(t.stringBuf))
+	}
+	encodedString := string(t.stringBuf[start:end])
 	return encodedString, nil
 }
 
@@ -102,12 +137,20 @@ func (t *TLK) AddString(stringId int, str string, sound string) {
 	/*if sound != "" {
 		copy(t.entries[stringId].Sound[0:], sound[0:])
 	}*/
-	t.entries[stringId].Offset = uint32(len(t.stringBuf))
+	t.entries[stringId].Offset = uint32(t.lazySize + int64(len(t.stringBuf)))
 	t.entries[stringId].Length = uint32(len(str))
 	t.header.StringOffset = uint32(binary.Size(t.header)) + uint32(len(t.entries)*binary.Size(t.entries[0]))
 	t.stringBuf = append(t.stringBuf, []byte(str)...)
 }
 
+// Stores str at stringId keeping the flags, sound, volume and pitch of entry
+func (t *TLK) setEntry(stringId int, str string, entry tlkEntry) {
+	t.AddString(stringId, str, "")
+	entry.Offset = t.entries[stringId].Offset
+	entry.Length = t.entries[stringId].Length
+	t.entries[stringId] = entry
+}
+
 func (t *TLK) Entry(stringId int) (*tlkEntry, error) {
 	if stringId >= len(t.entries) {
 		return nil, errors.New(fmt.Sprintf("Index out of range: %d >%d", stringId, len(t.entries)))
@@ -119,7 +162,46 @@ func (t *TLK) Entry(stringId int) (*tlkEntry, error) {
 	return &t.entries[stringId], nil
 }
 
+// Rebuilds the string data dropping bytes no longer referenced by any entry,
+// identical strings share a single offset.  A lazy TLK is fully loaded.
+func (t *TLK) Compact() error {
+	buf := make([]byte, 0, len(t.stringBuf))
+	offsets := make(map[string]uint32)
+	entries := make([]tlkEntry, len(t.entries))
+	copy(entries, t.entries)
+	for idx := range entries {
+		str, err := t.String(idx)
+		if err != nil {
+			return err
+		}
+		if len(str) == 0 {
+			entries[idx].Offset = 0
+			entries[idx].Length = 0
+			continue
+		}
+		offset, ok := offsets[str]
+		if !ok {
+			offset = uint32(len(buf))
+			offsets[str] = offset
+			buf = append(buf, str...)
+		}
+		entries[idx].Offset = offset
+	}
+	t.entries = entries
+	t.stringBuf = buf
+	t.ra = nil
+	t.lazyOffset = 0
+	t.lazySize = 0
+	t.header.StringOffset = uint32(binary.Size(t.header) + binary.Size(t.entries))
+	return nil
+}
+
 func (t *TLK) Write(w io.WriteSeeker) error {
+	if t.compact {
+		if err := t.Compact(); err != nil {
+			return err
+		}
+	}
 
 	w.Seek(0, os.SEEK_SET)
 	err := binary.Write(w, binary.LittleEndian, t.header)
@@ -131,6 +213,12 @@ func (t *TLK) Write(w io.WriteSeeker) error {
 		return err
 	}
 	w.Seek(0, os.SEEK_CUR)
+	if t.ra != nil {
+		_, err = io.Copy(w, io.NewSectionReader(t.ra, t.lazyOffset, t.lazySize))
+		if err != nil {
+			return err
+		}
+	}
 	_, err = w.Write(t.stringBuf)
 	if err != nil {
 		return err
@@ -231,15 +319,44 @@ func OpenTlk(r io.ReadSeeker) (*TLK, error) {
 	if err != nil {
 		return nil, err
 	}
-	tlkPos, err := r.Seek(0, os.SEEK_CUR)
-	tlk.stringBuf = make([]byte, tlkLen-tlkPos)
-	size, err := r.Read(tlk.stringBuf)
+	if int64(tlk.header.StringOffset) > tlkLen {
+		return nil, fmt.Errorf("String offset past end of file: %d > %d", tlk.header.StringOffset, tlkLen)
+	}
+	_, err = r.Seek(int64(tlk.header.StringOffset), os.SEEK_SET)
+	if err != nil {
+		return nil, err
+	}
+	tlk.stringBuf = make([]byte, tlkLen-int64(tlk.header.StringOffset))
+	_, err = io.ReadFull(r, tlk.stringBuf)
+	if err != nil {
+		return nil, err
+	}
+
+	return tlk, nil
+}
+
+// Opens a TLK reading only the header and entry table, strings are read from
+// r on demand.  r must remain valid for the lifetime of the TLK.
+func OpenTlkLazy(r io.ReaderAt) (*TLK, error) {
+	tlk := &TLK{ra: r, codepage: "latin1"}
+	sr := io.NewSectionReader(r, 0, math.MaxInt64)
+	err := binary.Read(sr, binary.LittleEndian, &tlk.header)
 	if err != nil {
 		return nil, err
 	}
-	if size != len(tlk.stringBuf) {
+
+	tlk.entries = make([]tlkEntry, tlk.header.StringCount)
+	err = binary.Read(sr, binary.LittleEndian, &tlk.entries)
+	if err != nil {
 		return nil, err
 	}
+	tlk.stringBuf = make([]byte, 0)
+	tlk.lazyOffset = int64(tlk.header.StringOffset)
+	for _, entry := range tlk.entries {
+		if end := int64(entry.Offset) + int64(entry.Length); end > tlk.lazySize {
+			tlk.lazySize = end
+		}
+	}
 
 	return tlk, nil
 }
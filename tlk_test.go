@@ -0,0 +1,219 @@
+package bg
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func newTestTlk(strs ...string) *TLK {
+	tlk, _ := NewTLK()
+	for idx, str := range strs {
+		tlk.AddString(idx, str, "")
+	}
+	return tlk
+}
+
+func writeTestTlk(t *testing.T, tlk *TLK) []byte {
+	f, err := ioutil.TempFile("", "tlk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if err = tlk.Write(f); err != nil {
+		t.Fatal(err)
+	}
+	buf, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+func TestOpenTlkLazy(t *testing.T) {
+	buf := writeTestTlk(t, newTestTlk("zero", "", "two"))
+
+	tlk, err := OpenTlkLazy(bytes.NewReader(buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if str, _ := tlk.String(2); str != "two" {
+		t.Errorf("Lazy string 2: %q != %q", str, "two")
+	}
+	tlk.AddString(1, "one", "")
+	tlk.AddString(3, "three", "")
+
+	eager, err := OpenTlk(bytes.NewReader(writeTestTlk(t, tlk)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for idx, expected := range []string{"zero", "one", "two", "three"} {
+		if str, _ := eager.String(idx); str != expected {
+			t.Errorf("String %d: %q != %q", idx, str, expected)
+		}
+	}
+
+	tlk, _ = OpenTlkLazy(bytes.NewReader(buf[:len(buf)-2]))
+	if _, err = tlk.String(2); err == nil {
+		t.Errorf("Truncated lazy string read without error")
+	}
+}
+
+func TestDiffTlk(t *testing.T) {
+	a := newTestTlk("zero", "one", "two")
+	b := newTestTlk("zero", "uno", "two", "three")
+	entry, _ := b.Entry(2)
+	entry.Sound = NewResref("TWO")
+
+	diffs, err := DiffTlk(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diffs) != 3 {
+		t.Fatalf("DiffTlk returned %d entries, expected 3: %+v", len(diffs), diffs)
+	}
+	if diffs[0].Strref != 1 || diffs[0].Type != TLK_CHANGED || !diffs[0].TextChanged() {
+		t.Errorf("Unexpected diff: %+v", diffs[0])
+	}
+	if diffs[1].Strref != 2 || diffs[1].TextChanged() || !diffs[1].SoundChanged() {
+		t.Errorf("Unexpected diff: %+v", diffs[1])
+	}
+	if diffs[2].Strref != 3 || diffs[2].Type != TLK_ADDED || diffs[2].New.Text != "three" {
+		t.Errorf("Unexpected diff: %+v", diffs[2])
+	}
+
+	diffs, _ = DiffTlk(b, a)
+	if diffs[2].Type != TLK_REMOVED || diffs[2].Old.Text != "three" {
+		t.Errorf("Unexpected diff: %+v", diffs[2])
+	}
+}
+
+func TestMergeTlk(t *testing.T) {
+	base := newTestTlk("zero", "one", "two")
+	ours := newTestTlk("zero", "ONE", "two", "three")
+	theirs := newTestTlk("nil", "one", "deux")
+
+	merged, conflicts, err := MergeTlk(base, ours, theirs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conflicts) != 0 {
+		t.Errorf("Unexpected conflicts: %+v", conflicts)
+	}
+	expected := []string{"nil", "ONE", "deux", "three"}
+	if merged.GetStringCount() != len(expected) {
+		t.Fatalf("Merged count %d != %d", merged.GetStringCount(), len(expected))
+	}
+	for idx, str := range expected {
+		if s, _ := merged.String(idx); s != str {
+			t.Errorf("Merged string %d: %q != %q", idx, s, str)
+		}
+	}
+
+	theirs.AddString(1, "uno", "")
+	_, conflicts, _ = MergeTlk(base, ours, theirs)
+	if len(conflicts) != 1 || conflicts[0].Strref != 1 || conflicts[0].Theirs.Text != "uno" {
+		t.Errorf("Unexpected conflicts: %+v", conflicts)
+	}
+
+	theirs.entries[2].Length = 1000
+	if _, _, err = MergeTlk(base, ours, theirs); err == nil {
+		t.Errorf("Expected error for overrunning string")
+	}
+}
+
+func TestTlkSearch(t *testing.T) {
+	tlk := newTestTlk("Greetings, traveller.", "The Sword Coast", "Swordfish", "sword coasting", "Élan vital", "café noir")
+	index, err := tlk.BuildIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	queries := []struct {
+		q        TlkQuery
+		expected []STRREF
+	}{
+		{TlkQuery{Text: "Sword"}, []STRREF{1, 2}},
+		{TlkQuery{Text: "sword coast", IgnoreCase: true}, []STRREF{1, 3}},
+		{TlkQuery{Text: "sword", Mode: TLK_SEARCH_WORD, IgnoreCase: true}, []STRREF{1, 3}},
+		{TlkQuery{Text: "ord co"}, []STRREF{3}},
+		{TlkQuery{Text: `^[A-Z]\w+,`, Mode: TLK_SEARCH_REGEXP}, []STRREF{0}},
+		{TlkQuery{Text: "élan", Mode: TLK_SEARCH_WORD, IgnoreCase: true}, []STRREF{4}},
+		{TlkQuery{Text: "lan", Mode: TLK_SEARCH_WORD}, []STRREF{}},
+		{TlkQuery{Text: "café", Mode: TLK_SEARCH_WORD}, []STRREF{5}},
+	}
+	for _, query := range queries {
+		for _, search := range []func(TlkQuery) ([]TlkMatch, error){tlk.Search, index.Search} {
+			matches, err := search(query.q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			refs := []STRREF{}
+			for _, m := range matches {
+				refs = append(refs, m.Strref)
+			}
+			if len(refs) != len(query.expected) {
+				t.Errorf("Search %+v: %v != %v", query.q, refs, query.expected)
+				continue
+			}
+			for idx := range refs {
+				if refs[idx] != query.expected[idx] {
+					t.Errorf("Search %+v: %v != %v", query.q, refs, query.expected)
+					break
+				}
+			}
+		}
+	}
+
+	matches, _ := tlk.Search(TlkQuery{Text: "sword", IgnoreCase: true})
+	if hl := matches[0].Highlight("[", "]"); hl != "The [Sword] Coast" {
+		t.Errorf("Highlight %q", hl)
+	}
+
+	western := newTestTlk("caf\xe9 noir", "\x93Sword\x94 \x80 5")
+	western.SetCodepage("latin1")
+	matches, _ = western.Search(TlkQuery{Text: "café", Mode: TLK_SEARCH_WORD})
+	if len(matches) != 1 || matches[0].Strref != 0 {
+		t.Errorf("Latin-1 search: %+v", matches)
+	}
+	index, _ = western.BuildIndex()
+	matches, _ = index.Search(TlkQuery{Text: "sword", Mode: TLK_SEARCH_WORD, IgnoreCase: true})
+	if len(matches) != 1 || matches[0].Highlight("[", "]") != "“[Sword]” € 5" {
+		t.Errorf("Windows-1252 search: %+v", matches)
+	}
+}
+
+func TestTlkCompact(t *testing.T) {
+	tlk := newTestTlk("same", "dead", "same", "")
+	tlk.AddString(1, "alive", "")
+	tlk.SetCompactOnWrite(true)
+
+	out, err := OpenTlk(bytes.NewReader(writeTestTlk(t, tlk)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out.stringBuf) != "samealive" {
+		t.Errorf("Compacted string data %q", out.stringBuf)
+	}
+	for idx, expected := range []string{"same", "alive", "same", ""} {
+		if str, _ := out.String(idx); str != expected {
+			t.Errorf("String %d: %q != %q", idx, str, expected)
+		}
+	}
+
+	buf := writeTestTlk(t, newTestTlk("old", "aaaa", "cccc"))
+	lazy, err := OpenTlkLazy(bytes.NewReader(buf[:len(buf)-2]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lazy.AddString(0, "new", "")
+	if err = lazy.Compact(); err == nil {
+		t.Errorf("Compacted a truncated TLK without error")
+	}
+	for idx, expected := range []string{"new", "aaaa"} {
+		if str, _ := lazy.String(idx); str != expected {
+			t.Errorf("String %d after failed compaction: %q != %q", idx, str, expected)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package bg
+
+const (
+	TLK_ADDED = iota
+	TLK_REMOVED
+	TLK_CHANGED
+)
+
+type TlkString struct {
+	Text  string
+	Sound string
+}
+
+type TlkDiffEntry struct {
+	Strref STRREF
+	Type   int
+	Old    TlkString
+	New    TlkString
+}
+
+type TlkConflict struct {
+	Strref STRREF
+	Base   *TlkString
+	Ours   *TlkString
+	Theirs *TlkString
+}
+
+func (d *TlkDiffEntry) TextChanged() bool {
+	return d.Old.Text != d.New.Text
+}
+
+func (d *TlkDiffEntry) SoundChanged() bool {
+	return d.Old.Sound != d.New.Sound
+}
+
+// Returns nil for entries past the end of the table
+func (t *TLK) tlkString(stringId int) (*TlkString, error) {
+	if stringId >= t.GetStringCount() {
+		return nil, nil
+	}
+	str, err := t.String(stringId)
+	if err != nil {
+		return nil, err
+	}
+	return &TlkString{Text: str, Sound: t.entries[stringId].Sound.String()}, nil
+}
+
+func sameTlkString(a, b *TlkString) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// Compares two TLKs and returns every STRREF that was added, removed or
+// changed going from a to b.
+func DiffTlk(a *TLK, b *TLK) ([]TlkDiffEntry, error) {
+	diffs := []TlkDiffEntry{}
+	count := a.GetStringCount()
+	if b.GetStringCount() > count {
+		count = b.GetStringCount()
+	}
+	for idx := 0; idx < count; idx++ {
+		old, err := a.tlkString(idx)
+		if err != nil {
+			return nil, err
+		}
+		cur, err := b.tlkString(idx)
+		if err != nil {
+			return nil, err
+		}
+		d := TlkDiffEntry{Strref: STRREF(idx)}
+		if old == nil {
+			d.Type = TLK_ADDED
+			d.New = *cur
+		} else if cur == nil {
+			d.Type = TLK_REMOVED
+			d.Old = *old
+		} else if *old != *cur {
+			d.Type = TLK_CHANGED
+			d.Old = *old
+			d.New = *cur
+		} else {
+			continue
+		}
+		diffs = append(diffs, d)
+	}
+	return diffs, nil
+}
+
+// Three way merge of two TLKs derived from base.  Entries changed on only one
+// side are taken from that side, entries changed identically on both sides
+// are taken once.  Entries changed differently on both sides are reported as
+// conflicts and resolved in favour of ours.
+func MergeTlk(base *TLK, ours *TLK, theirs *TLK) (*TLK, []TlkConflict, error) {
+	merged, err := NewTLK()
+	if err != nil {
+		return nil, nil, err
+	}
+	merged.header.LanguageID = ours.header.LanguageID
+	merged.codepage = ours.codepage
+
+	conflicts := []TlkConflict{}
+	count := base.GetStringCount()
+	if ours.GetStringCount() > count {
+		count = ours.GetStringCount()
+	}
+	if theirs.GetStringCount() > count {
+		count = theirs.GetStringCount()
+	}
+
+	for idx := 0; idx < count; idx++ {
+		b, err := base.tlkString(idx)
+		if err != nil {
+			return nil, nil, err
+		}
+		o, err := ours.tlkString(idx)
+		if err != nil {
+			return nil, nil, err
+		}
+		t, err := theirs.tlkString(idx)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		src := ours
+		switch {
+		case sameTlkString(o, t), sameTlkString(t, b):
+			// ours already holds the merged value
+		case sameTlkString(o, b):
+			src = theirs
+		default:
+			conflicts = append(conflicts, TlkConflict{Strref: STRREF(idx), Base: b, Ours: o, Theirs: t})
+		}
+
+		if idx < src.GetStringCount() {
+			str, err := src.String(idx)
+			if err != nil {
+				return nil, nil, err
+			}
+			merged.setEntry(idx, str, src.entries[idx])
+		}
+	}
+
+	return merged, conflicts, nil
+}
@@ -0,0 +1,293 @@
+package bg
+
+import (
+	"errors"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	TLK_SEARCH_SUBSTRING = iota
+	TLK_SEARCH_REGEXP
+	TLK_SEARCH_WORD
+)
+
+type TlkQuery struct {
+	Text       string
+	Mode       int
+	IgnoreCase bool
+}
+
+type TlkMatch struct {
+	Strref STRREF
+	Text   string
+	// Byte offsets of each match within Text
+	Ranges [][2]int
+}
+
+type TlkIndex struct {
+	strings []string
+	words   map[string][]STRREF
+	vocab   []string
+}
+
+type tlkMatcher func(string) [][2]int
+
+func (q TlkQuery) matcher() (tlkMatcher, error) {
+	if q.Text == "" {
+		return nil, errors.New("Empty search text")
+	}
+	if q.Mode == TLK_SEARCH_SUBSTRING && !q.IgnoreCase {
+		return func(s string) [][2]int {
+			var ranges [][2]int
+			for pos := 0; pos <= len(s); {
+				idx := strings.Index(s[pos:], q.Text)
+				if idx < 0 {
+					break
+				}
+				ranges = append(ranges, [2]int{pos + idx, pos + idx + len(q.Text)})
+				pos += idx + len(q.Text)
+			}
+			return ranges
+		}, nil
+	}
+
+	var expr string
+	switch q.Mode {
+	case TLK_SEARCH_SUBSTRING:
+		expr = regexp.QuoteMeta(q.Text)
+	case TLK_SEARCH_REGEXP:
+		expr = q.Text
+	case TLK_SEARCH_WORD:
+		expr = regexp.QuoteMeta(q.Text)
+	default:
+		return nil, errors.New("Unknown search mode")
+	}
+	if q.IgnoreCase {
+		expr = "(?i)" + expr
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+	return func(s string) [][2]int {
+		var ranges [][2]int
+		for _, loc := range re.FindAllStringIndex(s, -1) {
+			if q.Mode == TLK_SEARCH_WORD && !wordBoundaries(s, loc[0], loc[1]) {
+				continue
+			}
+			ranges = append(ranges, [2]int{loc[0], loc[1]})
+		}
+		return ranges
+	}, nil
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// Reports whether s[start:end] is not joined to a word on either side.  The
+// regexp \b only knows ASCII letters so the runes are checked the same way
+// tlkWords splits words.
+func wordBoundaries(s string, start int, end int) bool {
+	if r, _ := utf8.DecodeLastRuneInString(s[:start]); start > 0 && isWordRune(r) {
+		return false
+	}
+	if r, _ := utf8.DecodeRuneInString(s[end:]); end < len(s) && isWordRune(r) {
+		return false
+	}
+	return true
+}
+
+// Characters 0x80 to 0x9f of Windows-1252, the rest matches Latin-1.  The
+// five unassigned bytes map to the control characters like in Latin-1.
+var cp1252High = [32]rune{
+	'€', 0x81, '‚', 'ƒ', '„', '…', '†', '‡', 'ˆ', '‰', 'Š', '‹', 'Œ', 0x8d, 'Ž', 0x8f,
+	0x90, '‘', '’', '“', '”', '•', '–', '—', '˜', '™', 'š', '›', 'œ', 0x9d, 'ž', 'Ÿ',
+}
+
+// Decodes str from the codepage of the TLK.  Latin-1 TLKs are read as
+// Windows-1252, which the games use for western languages.
+func (t *TLK) tlkText(str string) string {
+	switch strings.ToLower(t.codepage) {
+	case "latin1", "iso-8859-1", "cp1252", "windows-1252":
+	default:
+		return str
+	}
+	runes := make([]rune, len(str))
+	for idx := 0; idx < len(str); idx++ {
+		if c := str[idx]; c >= 0x80 && c < 0xa0 {
+			runes[idx] = cp1252High[c-0x80]
+		} else {
+			runes[idx] = rune(c)
+		}
+	}
+	return string(runes)
+}
+
+// Wraps every matched range of the text in start and end
+func (m *TlkMatch) Highlight(start string, end string) string {
+	out := ""
+	pos := 0
+	for _, r := range m.Ranges {
+		out += m.Text[pos:r[0]] + start + m.Text[r[0]:r[1]] + end
+		pos = r[1]
+	}
+	return out + m.Text[pos:]
+}
+
+// Scans every string in the TLK for q and returns the matches in STRREF order.
+// Strings are decoded from the TLK codepage first, Text and Ranges refer to
+// the UTF-8 text.
+func (t *TLK) Search(q TlkQuery) ([]TlkMatch, error) {
+	match, err := q.matcher()
+	if err != nil {
+		return nil, err
+	}
+	matches := []TlkMatch{}
+	for idx := 0; idx < t.GetStringCount(); idx++ {
+		str, err := t.String(idx)
+		if err != nil {
+			return nil, err
+		}
+		str = t.tlkText(str)
+		if ranges := match(str); len(ranges) > 0 {
+			matches = append(matches, TlkMatch{Strref: STRREF(idx), Text: str, Ranges: ranges})
+		}
+	}
+	return matches, nil
+}
+
+func tlkWords(str string) []string {
+	return strings.FieldsFunc(strings.ToLower(str), func(r rune) bool {
+		return !isWordRune(r)
+	})
+}
+
+// Builds an inverted index over every word in the TLK for repeated searches.
+// The index keeps its own copy of the strings and does not see later changes
+// to the TLK.
+func (t *TLK) BuildIndex() (*TlkIndex, error) {
+	index := &TlkIndex{words: make(map[string][]STRREF)}
+	index.strings = make([]string, t.GetStringCount())
+	for idx := range index.strings {
+		str, err := t.String(idx)
+		if err != nil {
+			return nil, err
+		}
+		str = t.tlkText(str)
+		index.strings[idx] = str
+		for _, word := range tlkWords(str) {
+			refs := index.words[word]
+			if len(refs) == 0 || refs[len(refs)-1] != STRREF(idx) {
+				index.words[word] = append(refs, STRREF(idx))
+			}
+		}
+	}
+	for word := range index.words {
+		index.vocab = append(index.vocab, word)
+	}
+	sort.Strings(index.vocab)
+	return index, nil
+}
+
+func intersectStrrefs(a []STRREF, b []STRREF) []STRREF {
+	out := []STRREF{}
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		if a[i] < b[j] {
+			i++
+		} else if a[i] > b[j] {
+			j++
+		} else {
+			out = append(out, a[i])
+			i++
+			j++
+		}
+	}
+	return out
+}
+
+func unionStrrefs(a []STRREF, b []STRREF) []STRREF {
+	out := make([]STRREF, 0, len(a)+len(b))
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		if a[i] < b[j] {
+			out = append(out, a[i])
+			i++
+		} else if a[i] > b[j] {
+			out = append(out, b[j])
+			j++
+		} else {
+			out = append(out, a[i])
+			i++
+			j++
+		}
+	}
+	out = append(out, a[i:]...)
+	return append(out, b[j:]...)
+}
+
+// Returns the STRREFs that may contain q, or nil if every string has to be
+// checked
+func (index *TlkIndex) candidates(q TlkQuery) []STRREF {
+	if q.Mode == TLK_SEARCH_REGEXP {
+		return nil
+	}
+	words := tlkWords(q.Text)
+	if len(words) == 0 {
+		return nil
+	}
+	var refs []STRREF
+	for idx, word := range words {
+		var wordRefs []STRREF
+		if q.Mode == TLK_SEARCH_WORD {
+			wordRefs = index.words[word]
+		} else {
+			// The first and last words of a substring may be partial
+			for _, v := range index.vocab {
+				if (idx == 0 && idx == len(words)-1 && strings.Contains(v, word)) ||
+					(idx == 0 && idx != len(words)-1 && strings.HasSuffix(v, word)) ||
+					(idx != 0 && idx == len(words)-1 && strings.HasPrefix(v, word)) ||
+					v == word {
+					wordRefs = unionStrrefs(wordRefs, index.words[v])
+				}
+			}
+		}
+		if idx == 0 {
+			refs = wordRefs
+		} else {
+			refs = intersectStrrefs(refs, wordRefs)
+		}
+		if len(refs) == 0 {
+			return []STRREF{}
+		}
+	}
+	return refs
+}
+
+// Searches the indexed strings, only strings containing every word of the
+// query are checked unless the query is a regular expression
+func (index *TlkIndex) Search(q TlkQuery) ([]TlkMatch, error) {
+	match, err := q.matcher()
+	if err != nil {
+		return nil, err
+	}
+	refs := index.candidates(q)
+	if refs == nil {
+		refs = make([]STRREF, len(index.strings))
+		for idx := range refs {
+			refs[idx] = STRREF(idx)
+		}
+	}
+	matches := []TlkMatch{}
+	for _, ref := range refs {
+		str := index.strings[ref]
+		if ranges := match(str); len(ranges) > 0 {
+			matches = append(matches, TlkMatch{Strref: ref, Text: str, Ranges: ranges})
+		}
+	}
+	return matches, nil
+}
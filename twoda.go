@@ -0,0 +1,401 @@
+package bg
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// raw is the line the row was read from, it is written back unchanged as
+// long as the row is.  before holds the comment and blank lines preceding it.
+type TwoDARow struct {
+	Label  string
+	Values []string
+	raw    string
+	before []string
+}
+
+// Rows may have fewer values than there are columns, missing cells read as
+// the default value.  Lines starting with // are comments.  Encrypted files
+// are read transparently and written encrypted again unless Encrypted is
+// cleared.
+type TwoDA struct {
+	Signature string
+	Default   string
+	Columns   []string
+	Rows      []TwoDARow
+	Encrypted bool
+	raw       [3]string
+	trailer   []string
+	newline   string
+}
+
+func Open2DA(r io.Reader) (*TwoDA, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	encrypted := IsEncrypted(data)
+	data = Decrypt(data)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	lines := []string{}
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(lines) < 2 {
+		return nil, fmt.Errorf("2DA is missing its signature or default value")
+	}
+
+	table := &TwoDA{Signature: strings.TrimSpace(lines[0]), Encrypted: encrypted, newline: "\n"}
+	if bytes.Contains(data, []byte("\r\n")) {
+		table.newline = "\r\n"
+	}
+	copy(table.raw[:], lines)
+	if !strings.HasPrefix(strings.ToUpper(table.Signature), "2DA") {
+		return nil, fmt.Errorf("Invalid 2DA signature: %q", table.Signature)
+	}
+	table.Default = strings.TrimSpace(lines[1])
+	if len(lines) > 2 {
+		table.Columns = strings.Fields(lines[2])
+	}
+	comments := []string{}
+	for idx := 3; idx < len(lines); idx++ {
+		fields := strings.Fields(lines[idx])
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "//") {
+			comments = append(comments, lines[idx])
+			continue
+		}
+		table.Rows = append(table.Rows, TwoDARow{Label: fields[0], Values: fields[1:], raw: lines[idx], before: comments})
+		comments = nil
+	}
+	table.trailer = comments
+	return table, nil
+}
+
+// Returns the index of the row, labels are not case sensitive.  -1 is
+// returned for a missing row.
+func (t *TwoDA) RowIndex(label string) int {
+	for idx := range t.Rows {
+		if strings.EqualFold(t.Rows[idx].Label, label) {
+			return idx
+		}
+	}
+	return -1
+}
+
+// Returns the index of the column, labels are not case sensitive.  -1 is
+// returned for a missing column.
+func (t *TwoDA) ColumnIndex(label string) int {
+	for idx := range t.Columns {
+		if strings.EqualFold(t.Columns[idx], label) {
+			return idx
+		}
+	}
+	return -1
+}
+
+// Returns the cell at row and column index, the default value when it is
+// missing
+func (t *TwoDA) At(row int, col int) string {
+	if row < 0 || row >= len(t.Rows) || col < 0 || col >= len(t.Rows[row].Values) {
+		return t.Default
+	}
+	return t.Rows[row].Values[col]
+}
+
+func parse2DAInt(value string) (int, bool) {
+	if v, err := strconv.ParseInt(value, 10, 32); err == nil {
+		return int(v), true
+	}
+	if v, err := strconv.ParseInt(value, 0, 32); err == nil {
+		return int(v), true
+	}
+	return 0, false
+}
+
+// Returns the cell at row and column index as an integer, hex values are
+// accepted.  Cells that are missing or not numbers read as the default value,
+// or 0 when that is not a number either.
+func (t *TwoDA) AtInt(row int, col int) int {
+	if v, ok := parse2DAInt(t.At(row, col)); ok {
+		return v
+	}
+	v, _ := parse2DAInt(t.Default)
+	return v
+}
+
+// Returns the cell by row and column label
+func (t *TwoDA) Get(row string, col string) string {
+	return t.At(t.RowIndex(row), t.ColumnIndex(col))
+}
+
+// Returns the cell by row and column label as an integer
+func (t *TwoDA) GetInt(row string, col string) int {
+	return t.AtInt(t.RowIndex(row), t.ColumnIndex(col))
+}
+
+func (row *TwoDARow) fields() []string {
+	return append([]string{row.Label}, row.Values...)
+}
+
+func sameFields(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for idx := range a {
+		if a[idx] != b[idx] {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the offset each field of line starts at
+func fieldOffsets(line string) []int {
+	offsets := []int{}
+	inField := false
+	for idx := 0; idx < len(line); idx++ {
+		space := line[idx] == ' ' || line[idx] == '\t'
+		if !space && !inField {
+			offsets = append(offsets, idx)
+		}
+		inField = !space
+	}
+	return offsets
+}
+
+// Works out where each column starts, position 0 is the row label.  Columns
+// start where most unchanged rows have them, or where the header has them,
+// new columns are placed after the widest value of the column before.
+func (t *TwoDA) positions() []int {
+	counts := make([]map[int]int, len(t.Columns)+1)
+	for idx := range counts {
+		counts[idx] = make(map[int]int)
+	}
+	for _, row := range t.Rows {
+		if row.raw == "" || !sameFields(strings.Fields(row.raw), row.fields()) {
+			continue
+		}
+		for idx, offset := range fieldOffsets(row.raw) {
+			if idx < len(counts) {
+				counts[idx][offset]++
+			}
+		}
+	}
+	var header []int
+	if sameFields(strings.Fields(t.raw[2]), t.Columns) {
+		header = fieldOffsets(t.raw[2])
+	}
+
+	pos := make([]int, len(t.Columns)+1)
+	for idx := 1; idx < len(pos); idx++ {
+		best, bestCount := -1, 0
+		for offset, count := range counts[idx] {
+			if count > bestCount || (count == bestCount && offset < best) {
+				best, bestCount = offset, count
+			}
+		}
+		if best < 0 && header != nil {
+			best = header[idx-1]
+		}
+		width := 0
+		for _, row := range t.Rows {
+			if fields := row.fields(); idx-1 < len(fields) && len(fields[idx-1]) > width {
+				width = len(fields[idx-1])
+			}
+		}
+		if idx > 1 && len(t.Columns[idx-2]) > width {
+			width = len(t.Columns[idx-2])
+		}
+		if best <= pos[idx-1] {
+			best = pos[idx-1] + width + 2
+		}
+		pos[idx] = best
+	}
+	return pos
+}
+
+// Lays the fields out at the positions, a field that does not fit pushes
+// the rest along
+func formatFields(fields []string, pos []int) string {
+	var b strings.Builder
+	for idx, field := range fields {
+		pad := 0
+		if idx < len(pos) {
+			pad = pos[idx] - b.Len()
+		}
+		if idx > 0 && pad < 1 {
+			pad = 1
+		}
+		b.WriteString(strings.Repeat(" ", pad))
+		b.WriteString(field)
+	}
+	return b.String()
+}
+
+// Writes the table, rows that did not change are written as they were read
+// and changed rows are aligned with the others.  The table is encrypted when
+// Encrypted is set.
+func (t *TwoDA) Write(w io.Writer) error {
+	newline := t.newline
+	if newline == "" {
+		newline = "\r\n"
+	}
+	pos := t.positions()
+	lines := []string{t.raw[0], t.raw[1], t.raw[2]}
+	if strings.TrimSpace(lines[0]) != t.Signature {
+		lines[0] = t.Signature
+	}
+	if strings.TrimSpace(lines[1]) != t.Default {
+		lines[1] = t.Default
+	}
+	if !sameFields(strings.Fields(lines[2]), t.Columns) {
+		lines[2] = formatFields(t.Columns, pos[1:])
+	}
+	for _, row := range t.Rows {
+		lines = append(lines, row.before...)
+		if row.raw != "" && sameFields(strings.Fields(row.raw), row.fields()) {
+			lines = append(lines, row.raw)
+		} else {
+			lines = append(lines, formatFields(row.fields(), pos))
+		}
+	}
+	lines = append(lines, t.trailer...)
+	data := []byte(strings.Join(lines, newline) + newline)
+	if t.Encrypted {
+		data = Encrypt(data)
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+// Cells and labels are a single word, anything else would change the columns
+// when the table is read back
+func check2DAField(value string) error {
+	if fields := strings.Fields(value); len(fields) != 1 || fields[0] != value {
+		return fmt.Errorf("Invalid cell value: %q", value)
+	}
+	return nil
+}
+
+// Appends a row and returns its index, missing values read as the default
+func (t *TwoDA) AddRow(label string, values ...string) (int, error) {
+	if len(values) > len(t.Columns) {
+		return -1, fmt.Errorf("Too many values: %d > %d", len(values), len(t.Columns))
+	}
+	for _, value := range append([]string{label}, values...) {
+		if err := check2DAField(value); err != nil {
+			return -1, err
+		}
+	}
+	t.Rows = append(t.Rows, TwoDARow{Label: label, Values: values})
+	return len(t.Rows) - 1, nil
+}
+
+// Removes the row, comments before it are kept with the row that follows
+func (t *TwoDA) RemoveRow(label string) error {
+	idx := t.RowIndex(label)
+	if idx < 0 {
+		return fmt.Errorf("No such row: %s", label)
+	}
+	if idx+1 < len(t.Rows) {
+		t.Rows[idx+1].before = append(t.Rows[idx].before, t.Rows[idx+1].before...)
+	} else {
+		t.trailer = append(t.Rows[idx].before, t.trailer...)
+	}
+	t.Rows = append(t.Rows[:idx], t.Rows[idx+1:]...)
+	return nil
+}
+
+func (t *TwoDA) RenameRow(label string, newLabel string) error {
+	idx := t.RowIndex(label)
+	if idx < 0 {
+		return fmt.Errorf("No such row: %s", label)
+	}
+	if err := check2DAField(newLabel); err != nil {
+		return err
+	}
+	t.Rows[idx].Label = newLabel
+	return nil
+}
+
+// Appends a column, every row gets value in it
+func (t *TwoDA) AddColumn(name string, value string) error {
+	if err := check2DAField(name); err != nil {
+		return err
+	}
+	if err := check2DAField(value); err != nil {
+		return err
+	}
+	t.Columns = append(t.Columns, name)
+	for idx := range t.Rows {
+		t.SetAt(idx, len(t.Columns)-1, value)
+	}
+	return nil
+}
+
+func (t *TwoDA) RemoveColumn(name string) error {
+	col := t.ColumnIndex(name)
+	if col < 0 {
+		return fmt.Errorf("No such column: %s", name)
+	}
+	t.Columns = append(t.Columns[:col], t.Columns[col+1:]...)
+	for idx := range t.Rows {
+		row := &t.Rows[idx]
+		if col < len(row.Values) {
+			row.Values = append(row.Values[:col:col], row.Values[col+1:]...)
+		}
+	}
+	return nil
+}
+
+func (t *TwoDA) RenameColumn(name string, newName string) error {
+	col := t.ColumnIndex(name)
+	if col < 0 {
+		return fmt.Errorf("No such column: %s", name)
+	}
+	if err := check2DAField(newName); err != nil {
+		return err
+	}
+	t.Columns[col] = newName
+	return nil
+}
+
+// Sets the cell at row and column index, a row missing the cells before it
+// is padded with the default value
+func (t *TwoDA) SetAt(row int, col int, value string) error {
+	if row < 0 || row >= len(t.Rows) {
+		return fmt.Errorf("Row out of range: %d", row)
+	}
+	if col < 0 || col >= len(t.Columns) {
+		return fmt.Errorf("Column out of range: %d", col)
+	}
+	if err := check2DAField(value); err != nil {
+		return err
+	}
+	r := &t.Rows[row]
+	for len(r.Values) <= col {
+		r.Values = append(r.Values, t.Default)
+	}
+	r.Values[col] = value
+	return nil
+}
+
+// Sets the cell by row and column label
+func (t *TwoDA) Set(row string, col string, value string) error {
+	rowIdx, colIdx := t.RowIndex(row), t.ColumnIndex(col)
+	if rowIdx < 0 {
+		return fmt.Errorf("No such row: %s", row)
+	}
+	if colIdx < 0 {
+		return fmt.Errorf("No such column: %s", col)
+	}
+	return t.SetAt(rowIdx, colIdx, value)
+}
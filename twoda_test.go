@@ -0,0 +1,173 @@
+package bg
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const test2DA = `2DA V1.0
+0
+         LEVEL   XP      NAME
+FIGHTER  1       0x10    Fighter
+MAGE     2       2000
+08       3       08      Eight
+
+`
+
+func TestOpen2DA(t *testing.T) {
+	table, err := Open2DA(strings.NewReader(test2DA))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if table.Default != "0" || len(table.Columns) != 3 || len(table.Rows) != 3 {
+		t.Fatalf("Bad table: %+v", table)
+	}
+	tests := []struct {
+		row, col string
+		str      string
+		num      int
+	}{
+		{"fighter", "xp", "0x10", 16},
+		{"MAGE", "NAME", "0", 0},
+		{"MAGE", "XP", "2000", 2000},
+		{"08", "XP", "08", 8},
+		{"08", "NAME", "Eight", 0},
+		{"THIEF", "XP", "0", 0},
+		{"FIGHTER", "MISSING", "0", 0},
+	}
+	for _, test := range tests {
+		if str := table.Get(test.row, test.col); str != test.str {
+			t.Errorf("%s/%s: got %q, expected %q", test.row, test.col, str, test.str)
+		}
+		if num := table.GetInt(test.row, test.col); num != test.num {
+			t.Errorf("%s/%s: got %d, expected %d", test.row, test.col, num, test.num)
+		}
+	}
+	if table.At(1, 0) != "2" || table.AtInt(2, 1) != 8 || table.RowIndex("mage") != 1 || table.ColumnIndex("Name") != 2 {
+		t.Errorf("Bad index lookups")
+	}
+
+	if _, err = Open2DA(strings.NewReader("IDS V1.0\n0\n")); err == nil {
+		t.Errorf("Expected error for bad signature")
+	}
+}
+
+func TestWrite2DA(t *testing.T) {
+	src := "2DA V1.0\r\n****\r\n         LEVEL   XP\r\n// fighters\r\nFIGHTER  1       0x10\r\nMAGE     2       2000\r\nTHIEF    3\r\n"
+	table, err := Open2DA(strings.NewReader(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err = table.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != src {
+		t.Errorf("2DA did not round trip:\n%q", buf.String())
+	}
+
+	if err = table.Set("thief", "XP", "1250000"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = table.AddRow("BARD", "4", "0"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = table.AddRow("BAD", "4", "1 2"); err == nil || len(table.Rows) != 4 {
+		t.Errorf("Expected error for value with a space")
+	}
+	if _, err = table.AddRow("BAD", "4", "1", "2"); err == nil || len(table.Rows) != 4 {
+		t.Errorf("Expected error for more values than columns")
+	}
+	if err = table.RemoveRow("FIGHTER"); err != nil {
+		t.Fatal(err)
+	}
+	if err = table.RenameRow("MAGE", "WIZARD"); err != nil {
+		t.Fatal(err)
+	}
+	if err = table.Set("MAGE", "XP", "1"); err == nil {
+		t.Errorf("Expected error for renamed row")
+	}
+	buf.Reset()
+	table.Write(&buf)
+	expected := "2DA V1.0\r\n****\r\n         LEVEL   XP\r\n// fighters\r\nWIZARD   2       2000\r\nTHIEF    3       1250000\r\nBARD     4       0\r\n"
+	if buf.String() != expected {
+		t.Errorf("Bad edited 2DA:\n%s", buf.String())
+	}
+
+	if err = table.AddColumn("NAME", " "); err == nil || len(table.Columns) != 2 {
+		t.Errorf("Expected error for empty column value")
+	}
+	if err = table.AddColumn("NAME", "****"); err != nil {
+		t.Fatal(err)
+	}
+	if err = table.RenameColumn("LEVEL", "LVL"); err != nil {
+		t.Fatal(err)
+	}
+	if err = table.RemoveColumn("XP"); err != nil {
+		t.Fatal(err)
+	}
+	table.SetAt(2, 1, "Bard")
+	buf.Reset()
+	table.Write(&buf)
+	expected = "2DA V1.0\r\n****\r\n        LVL  NAME\r\n// fighters\r\nWIZARD  2    ****\r\nTHIEF   3    ****\r\nBARD    4    Bard\r\n"
+	if buf.String() != expected {
+		t.Errorf("Bad edited columns:\n%s", buf.String())
+	}
+	if err = table.SetAt(0, 5, "x"); err == nil {
+		t.Errorf("Expected error for missing column")
+	}
+}
+
+func TestEncrypted2DA(t *testing.T) {
+	src := []byte("2DA V1.0\n0\n   A\nROW 1\n")
+	encrypted := Encrypt(src)
+	if !IsEncrypted(encrypted) || !bytes.Equal(Decrypt(encrypted), src) || !bytes.Equal(Decrypt(src), src) {
+		t.Fatalf("Bad encryption")
+	}
+	table, err := Open2DA(bytes.NewReader(encrypted))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !table.Encrypted || table.GetInt("ROW", "A") != 1 {
+		t.Errorf("Bad encrypted 2DA: %+v", table)
+	}
+	var buf bytes.Buffer
+	if err = table.Write(&buf); err != nil || !bytes.Equal(buf.Bytes(), encrypted) {
+		t.Errorf("Encrypted 2DA not written encrypted: %q %v", buf.Bytes(), err)
+	}
+
+	dir, err := ioutil.TempDir("", "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err = os.Mkdir(filepath.Join(dir, "override"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(dir, "override", "TEST.2DA"), encrypted, 0644); err != nil {
+		t.Fatal(err)
+	}
+	key := &KEY{root: dir, files: map[keyUniqueResource]*keyResourceEntry{}}
+	data, err := key.OpenFile("TEST.2DA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if table, err = Open2DA(bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	buf.Reset()
+	if err = table.Write(&buf); err != nil || !bytes.Equal(buf.Bytes(), encrypted) {
+		t.Errorf("2DA read through KEY not written back encrypted: %q %v", buf.Bytes(), err)
+	}
+	ini, err := OpenINI(bytes.NewReader(Encrypt([]byte("[Section]\nkey=value\n"))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, _ := ini.Get("Section", "key"); value != "value" {
+		t.Errorf("Bad encrypted INI: %+v", ini)
+	}
+}
@@ -0,0 +1,156 @@
+package bg
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// A VoiceLine is a single string spoken by one or more NPCs.  Contexts are
+// the player replies leading to the line, Sources name the states or soundset
+// slots it was found in.
+type VoiceLine struct {
+	Strref       uint32
+	Speakers     []string
+	Text         string
+	Sound        string
+	Contexts     []string
+	Sources      []string
+	MissingSound bool
+}
+
+type VoiceScript struct {
+	Lines []VoiceLine
+	lines map[uint32]int
+}
+
+func NewVoiceScript() *VoiceScript {
+	return &VoiceScript{lines: make(map[uint32]int)}
+}
+
+// Appends the strings not already in list
+func appendNew(list []string, strs ...string) []string {
+	for _, str := range strs {
+		found := false
+		for _, existing := range list {
+			if existing == str {
+				found = true
+				break
+			}
+		}
+		if !found {
+			list = append(list, str)
+		}
+	}
+	return list
+}
+
+// Adds a line, a STRREF spoken in several places is listed once with every
+// speaker and context
+func (vs *VoiceScript) addLine(line VoiceLine, tlk *TLK) {
+	if idx, ok := vs.lines[line.Strref]; ok {
+		existing := &vs.Lines[idx]
+		existing.Speakers = appendNew(existing.Speakers, line.Speakers...)
+		existing.Contexts = appendNew(existing.Contexts, line.Contexts...)
+		existing.Sources = appendNew(existing.Sources, line.Sources...)
+		return
+	}
+	line.Contexts = appendNew(nil, line.Contexts...)
+	if tlk != nil {
+		line.Text = fetch(tlk, line.Strref)
+		if entry, _ := tlk.Entry(int(line.Strref)); entry != nil {
+			line.Sound = entry.Sound.String()
+		}
+	}
+	line.MissingSound = line.Text != "" && line.Sound == ""
+	vs.lines[line.Strref] = len(vs.Lines)
+	vs.Lines = append(vs.Lines, line)
+}
+
+// Adds every state of the dialog, speaker defaults to the dialog name
+func (vs *VoiceScript) AddDialog(name string, dlg *DLG, tlk *TLK, speaker string) {
+	name = strings.ToUpper(name)
+	if speaker == "" {
+		speaker = name
+	}
+	contexts := make(map[int][]string)
+	for _, state := range dlg.States {
+		for _, trans := range dlg.stateTransitions(state) {
+			next := strings.ToUpper(trans.NextDlg.String())
+			if trans.TerminatesDialog() || !trans.HasText() || (next != "" && next != name) {
+				continue
+			}
+			reply := fmt.Sprintf("#%d", trans.TransitionText)
+			if tlk != nil {
+				reply = fetch(tlk, trans.TransitionText)
+			}
+			contexts[int(trans.NextState)] = append(contexts[int(trans.NextState)], reply)
+		}
+	}
+	for sIdx, state := range dlg.States {
+		if int32(state.Stringref) < 0 {
+			continue
+		}
+		vs.addLine(VoiceLine{
+			Strref:   state.Stringref,
+			Speakers: []string{speaker},
+			Contexts: contexts[sIdx],
+			Sources:  []string{fmt.Sprintf("%s.DLG state %d", name, sIdx)},
+		}, tlk)
+	}
+}
+
+// Adds the soundset of the creature, speaker defaults to the creature name
+func (vs *VoiceScript) AddCre(name string, cre *CRE, tlk *TLK, speaker string) {
+	name = strings.ToUpper(name)
+	if speaker == "" {
+		speaker = name
+		if tlk != nil {
+			speaker = fetch(tlk, cre.Header.Name)
+		}
+	}
+	for slot, strref := range cre.Header.Speech {
+		if int32(strref) <= 0 {
+			continue
+		}
+		vs.addLine(VoiceLine{
+			Strref:   strref,
+			Speakers: []string{speaker},
+			Contexts: []string{fmt.Sprintf("soundset slot %d", slot)},
+			Sources:  []string{fmt.Sprintf("%s.CRE speech %d", name, slot)},
+		}, tlk)
+	}
+}
+
+// Writes one row per line, speakers and sources are separated by commas and
+// contexts by |
+func (vs *VoiceScript) WriteCsv(w io.Writer) error {
+	out := csv.NewWriter(w)
+	err := out.Write([]string{"strref", "speaker", "text", "sound", "context", "source", "missing_sound"})
+	if err != nil {
+		return err
+	}
+	for _, line := range vs.Lines {
+		err = out.Write([]string{
+			strconv.Itoa(int(line.Strref)), strings.Join(line.Speakers, ", "), line.Text, line.Sound,
+			strings.Join(line.Contexts, " | "), strings.Join(line.Sources, ", "), strconv.FormatBool(line.MissingSound),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	out.Flush()
+	return out.Error()
+}
+
+func (vs *VoiceScript) WriteJson(w io.Writer) error {
+	bytes, err := json.MarshalIndent(vs.Lines, "", "\t")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(bytes)
+	return err
+}
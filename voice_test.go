@@ -0,0 +1,59 @@
+package bg
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestVoiceScript(t *testing.T) {
+	tlk := newTestTlk("", "Greetings", "Farewell", "Yes please", "Yes")
+	entry, _ := tlk.Entry(1)
+	entry.Sound = NewResref("GREET")
+	dlg := &DLG{
+		States: []DlgState{
+			{Stringref: 1, TransitionIndex: 0, TransitionCount: 2, TriggerIndex: -1},
+			{Stringref: 2, TransitionIndex: 2, TransitionCount: 1, TriggerIndex: -1},
+		},
+		Transitions: []DlgTransition{
+			{Flags: DLG_TRANS_TEXT, TransitionText: 3, NextState: 1},
+			{Flags: DLG_TRANS_TEXT, TransitionText: 4, NextState: 1},
+			{Flags: DLG_TRANS_EXIT},
+		},
+	}
+	other := &DLG{
+		States:      []DlgState{{Stringref: 0xffffffff, TransitionCount: 1, TriggerIndex: -1}, {Stringref: 2, TriggerIndex: -1}},
+		Transitions: []DlgTransition{{Flags: DLG_TRANS_TEXT, TransitionText: 4, NextState: 1}},
+	}
+	cre := &CRE{}
+	cre.Header.Speech[3] = 1
+
+	vs := NewVoiceScript()
+	vs.AddDialog("first", dlg, tlk, "")
+	vs.AddDialog("other", other, tlk, "Imoen")
+	vs.AddCre("minsc", cre, tlk, "Minsc")
+	if len(vs.Lines) != 2 {
+		t.Fatalf("Unexpected lines: %+v", vs.Lines)
+	}
+	expected := []VoiceLine{
+		{Strref: 1, Speakers: []string{"FIRST", "Minsc"}, Text: "Greetings", Sound: "GREET",
+			Contexts: []string{"soundset slot 3"}, Sources: []string{"FIRST.DLG state 0", "MINSC.CRE speech 3"}},
+		{Strref: 2, Speakers: []string{"FIRST", "Imoen"}, Text: "Farewell", Contexts: []string{"Yes please", "Yes"},
+			Sources: []string{"FIRST.DLG state 1", "OTHER.DLG state 1"}, MissingSound: true},
+	}
+	for idx := range expected {
+		if !reflect.DeepEqual(vs.Lines[idx], expected[idx]) {
+			t.Errorf("Line %d:\n%+v\n%+v", idx, vs.Lines[idx], expected[idx])
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := vs.WriteCsv(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if rows := strings.Split(buf.String(), "\n"); len(rows) != 4 ||
+		rows[2] != "2,\"FIRST, Imoen\",Farewell,,Yes please | Yes,\"FIRST.DLG state 1, OTHER.DLG state 1\",true" {
+		t.Errorf("Unexpected CSV:\n%s", buf.String())
+	}
+}